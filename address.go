@@ -25,9 +25,9 @@ func (m *Address) UnmarshalBinary(b []byte) error {
 	return nil
 }
 func (m *Address) MarshalBinary() ([]byte, error) {
-	b := make([]byte, 28)
+	b := make([]byte, 26)
 	order.PutUint64(b, uint64(m.Services.value()))
-	copy(b[8:], m.IP)
+	copy(b[8:], m.IP.To16())
 	order.PutUint16(b[24:], m.Port)
 	return b, nil
 }
@@ -0,0 +1,164 @@
+package bitmessage
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBanThreshold = 100
+	DefaultBanDuration  = time.Hour * 24
+	// MisbehaviorDecay is how long it takes for a peer's misbehavior score to drop by one point
+	MisbehaviorDecay = time.Minute
+)
+
+// Violation is a type of protocol misbehavior by a peer
+type Violation int
+
+const (
+	ViolationBadChecksum Violation = iota
+	ViolationOversizedMessage
+	ViolationMalformedMessage
+	ViolationInvalidPOW
+	ViolationInvalidObject
+)
+
+// ViolationPenalties are the scores added to a peer for each violation, scores decay by one point every MisbehaviorDecay.
+// A peer is disconnected and banned when its score reaches Config.BanThreshold.
+// Unknown commands are not a violation, they are ignored as newer protocol versions and extensions add them.
+var ViolationPenalties = map[Violation]int{
+	ViolationBadChecksum:      20,
+	ViolationOversizedMessage: 100,
+	ViolationMalformedMessage: 50,
+	ViolationInvalidPOW:       50,
+	ViolationInvalidObject:    10,
+}
+
+func (v Violation) String() string {
+	switch v {
+	case ViolationBadChecksum:
+		return "bad checksum"
+	case ViolationOversizedMessage:
+		return "oversized message"
+	case ViolationMalformedMessage:
+		return "malformed message"
+	case ViolationInvalidPOW:
+		return "invalid proof of work"
+	case ViolationInvalidObject:
+		return "invalid object"
+	}
+	return fmt.Sprintf("violation %d", int(v))
+}
+
+// Ban is an IP address that is refused connections until a given time
+type Ban struct {
+	IP     net.IP
+	Until  time.Time
+	Reason string
+}
+
+type banList struct {
+	mx   sync.Mutex
+	bans map[string]Ban
+}
+
+func newBanList() *banList {
+	return &banList{bans: make(map[string]Ban)}
+}
+
+// Add will ban ip for d
+func (b *banList) Add(ip net.IP, d time.Duration, reason string) {
+	b.mx.Lock()
+	b.bans[ip.String()] = Ban{IP: ip, Until: time.Now().Add(d), Reason: reason}
+	b.mx.Unlock()
+}
+
+// Banned will return true if ip is currently banned
+func (b *banList) Banned(ip net.IP) bool {
+	key := ip.String()
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	ban, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Until) {
+		delete(b.bans, key)
+		return false
+	}
+	return true
+}
+
+// Ban will refuse connections to and from ip for d, and disconnect any connected peers using it
+func (n *Node) Ban(ip net.IP, d time.Duration, reason string) {
+	n.bans.Add(ip, d, reason)
+
+	n.poolmx.RLock()
+	for _, c := range n.pool {
+		if c.remoteIP().Equal(ip) {
+			c.c.Close()
+		}
+	}
+	n.poolmx.RUnlock()
+}
+
+// Unban will remove ip from the ban list, returning false if it was not banned
+func (n *Node) Unban(ip net.IP) bool {
+	key := ip.String()
+	n.bans.mx.Lock()
+	defer n.bans.mx.Unlock()
+	_, ok := n.bans.bans[key]
+	delete(n.bans.bans, key)
+	return ok
+}
+
+// Bans will return the currently active bans
+func (n *Node) Bans() []Ban {
+	now := time.Now()
+	n.bans.mx.Lock()
+	defer n.bans.mx.Unlock()
+	result := make([]Ban, 0, len(n.bans.bans))
+	for key, ban := range n.bans.bans {
+		if now.After(ban.Until) {
+			delete(n.bans.bans, key)
+			continue
+		}
+		result = append(result, ban)
+	}
+	return result
+}
+
+func (c *connection) remoteIP() net.IP {
+	host, _, err := net.SplitHostPort(c.c.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// misbehave will add the penalty for v to the peer's score, it returns an error
+// if the peer has reached the ban threshold and should be disconnected
+func (c *connection) misbehave(v Violation, reason error) error {
+	now := time.Now()
+	c.scoremx.Lock()
+	decay := now.Sub(c.scored) / MisbehaviorDecay
+	c.score -= int(decay)
+	c.scored = c.scored.Add(decay * MisbehaviorDecay)
+	if c.score <= 0 {
+		c.score = 0
+		c.scored = now
+	}
+	c.score += ViolationPenalties[v]
+	score := c.score
+	c.scoremx.Unlock()
+	c.log.Warnf("%s (score %d): %s", v, score, reason)
+	if score < c.node.cfg.BanThreshold {
+		return nil
+	}
+	if ip := c.remoteIP(); ip != nil {
+		c.node.bans.Add(ip, c.node.cfg.BanDuration, fmt.Sprintf("%s: %s", v, reason))
+	}
+	return fmt.Errorf("misbehavior score %d reached ban threshold, last was %s: %s", score, v, reason)
+}
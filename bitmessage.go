@@ -14,6 +14,9 @@ const (
 	HandshakeTimeout           = time.Second * 20
 	ConnectionTimeout          = time.Minute * 10
 	MaxObjectExpiresTime       = time.Hour * (24*28 + 3)
+	MaxInventoryLength         = 50000
+	GetDataInterval            = time.Millisecond * 10
+	RelayInterval              = time.Second
 )
 
 var order = binary.BigEndian
@@ -0,0 +1,176 @@
+package bitmessage
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/ripemd160"
+	"math/big"
+	"strings"
+)
+
+const BMAddressPrefix = "BM-"
+
+var ErrAddressChecksum = errors.New("address checksum mismatch")
+var ErrAddressVersion = errors.New("unsupported address version")
+var ErrAddressEncoding = errors.New("invalid address encoding")
+
+// BMAddress is a Bitmessage address, e.g. BM-2cWy7cvHoq3f1rYMerRJp8PT653jjSuEdY
+type BMAddress struct {
+	Version uint64
+	Stream  uint64
+	Ripe    [20]byte
+}
+
+// CalcRipe will return the RIPEMD-160 of the SHA-512 of the uncompressed signing and encryption keys
+func CalcRipe(signingKey, encryptionKey *btcec.PublicKey) [20]byte {
+	h := sha512.New()
+	h.Write(signingKey.SerializeUncompressed())
+	h.Write(encryptionKey.SerializeUncompressed())
+	r := ripemd160.New()
+	r.Write(h.Sum(nil))
+	var ripe [20]byte
+	copy(ripe[:], r.Sum(nil))
+	return ripe
+}
+
+// NewBMAddress will return the address for a pair of public keys
+func NewBMAddress(version, stream uint64, signingKey, encryptionKey *btcec.PublicKey) *BMAddress {
+	return &BMAddress{Version: version, Stream: stream, Ripe: CalcRipe(signingKey, encryptionKey)}
+}
+
+// ParseBMAddress will decode an address, the BM- prefix is optional
+func ParseBMAddress(s string) (*BMAddress, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), BMAddressPrefix)
+	data, err := decodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 7 {
+		return nil, ErrAddressEncoding
+	}
+	sum := bmChecksum(data[:len(data)-4])
+	if !bytes.Equal(sum[:4], data[len(data)-4:]) {
+		return nil, ErrAddressChecksum
+	}
+	data = data[:len(data)-4]
+
+	var a BMAddress
+	var n int
+	a.Version, n = decodeBitmessageUvarint(data)
+	if n == 0 {
+		return nil, ErrAddressEncoding
+	}
+	data = data[n:]
+	if a.Version < 2 || a.Version > 4 {
+		return nil, ErrAddressVersion
+	}
+	a.Stream, n = decodeBitmessageUvarint(data)
+	if n == 0 {
+		return nil, ErrAddressEncoding
+	}
+	ripe := data[n:]
+	switch {
+	case len(ripe) > 20:
+		return nil, ErrAddressEncoding
+	case a.Version == 4 && (len(ripe) < 4 || ripe[0] == 0):
+		// v4 strips every leading zero so the ripe may not start with one
+		return nil, ErrAddressEncoding
+	case a.Version < 4 && len(ripe) < 18:
+		return nil, ErrAddressEncoding
+	}
+	copy(a.Ripe[20-len(ripe):], ripe)
+	return &a, nil
+}
+
+// addressData will return the version, stream and full ripe as used for tags and keys
+func (a *BMAddress) addressData() []byte {
+	b := make([]byte, 18, 38)
+	n := encodeBitmessageUvarint(b, a.Version)
+	n += encodeBitmessageUvarint(b[n:], a.Stream)
+	return append(b[:n], a.Ripe[:]...)
+}
+
+func (a *BMAddress) String() string {
+	ripe := a.Ripe[:]
+	if a.Version >= 4 {
+		ripe = bytes.TrimLeft(ripe, "\x00")
+	} else if bytes.HasPrefix(ripe, []byte{0, 0}) {
+		ripe = ripe[2:]
+	} else if ripe[0] == 0 {
+		ripe = ripe[1:]
+	}
+	b := make([]byte, 18, 42)
+	n := encodeBitmessageUvarint(b, a.Version)
+	n += encodeBitmessageUvarint(b[n:], a.Stream)
+	b = append(b[:n], ripe...)
+	sum := bmChecksum(b)
+	return BMAddressPrefix + encodeBase58(append(b, sum[:4]...))
+}
+
+// doubleHash is the source of the v4 tag and address-derived private key
+func (a *BMAddress) doubleHash() [64]byte {
+	h := sha512.Sum512(a.addressData())
+	return sha512.Sum512(h[:])
+}
+
+// Tag will return the tag used to find getpubkey, pubkey and broadcast objects for a v4 address
+func (a *BMAddress) Tag() [32]byte {
+	var tag [32]byte
+	h := a.doubleHash()
+	copy(tag[:], h[32:])
+	return tag
+}
+
+// PrivateKey will return the key derived from the address, used to encrypt v4 pubkeys
+// and broadcasts. Anyone who knows the address can derive it.
+func (a *BMAddress) PrivateKey() *btcec.PrivateKey {
+	var key []byte
+	if a.Version >= 4 {
+		h := a.doubleHash()
+		key = h[:32]
+	} else {
+		h := sha512.Sum512(a.addressData())
+		key = h[:32]
+	}
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), key)
+	return priv
+}
+
+func bmChecksum(b []byte) [64]byte {
+	h := sha512.Sum512(b)
+	return sha512.Sum512(h[:])
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var big58 = big.NewInt(58)
+
+func encodeBase58(b []byte) string {
+	x := new(big.Int).SetBytes(b)
+	mod := new(big.Int)
+	var result []byte
+	for x.Sign() > 0 {
+		x.DivMod(x, big58, mod)
+		result = append(result, base58Alphabet[mod.Int64()])
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return string(result)
+}
+
+func decodeBase58(s string) ([]byte, error) {
+	x := new(big.Int)
+	for _, c := range []byte(s) {
+		i := strings.IndexByte(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character '%c'", c)
+		}
+		x.Mul(x, big58)
+		x.Add(x, big.NewInt(int64(i)))
+	}
+	return x.Bytes(), nil
+}
@@ -0,0 +1,71 @@
+package bitmessage
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestBMAddressRoundTrip(t *testing.T) {
+	tests := []struct {
+		addr    string
+		version uint64
+		stream  uint64
+		ripe    string
+	}{
+		{"BM-onkVu1KKL2UaUss5Upg9vXmqd3esTmV79", 2, 1, "003cd097eb7f35c87b5dc8b4538c22cb55312a9f"},
+		{"BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK", 4, 1, "00cfb69416ae76f68a81c459de4e13460c7d17eb"},
+		{"BM-2cWFgvNK54GnDaMpATdEkr1xUPrJ9xoNgJ", 4, 1, "00ac059de0bf7bf248343883a3ba61402cc22dce"},
+	}
+	for _, test := range tests {
+		a, err := ParseBMAddress(test.addr)
+		if err != nil {
+			t.Errorf("%s: %s", test.addr, err)
+			continue
+		}
+		if a.Version != test.version || a.Stream != test.stream {
+			t.Errorf("%s: got version %d stream %d, expected %d and %d", test.addr, a.Version, a.Stream, test.version, test.stream)
+		}
+		if ripe := hex.EncodeToString(a.Ripe[:]); ripe != test.ripe {
+			t.Errorf("%s: got ripe %s, expected %s", test.addr, ripe, test.ripe)
+		}
+		if s := a.String(); s != test.addr {
+			t.Errorf("got %s, expected %s", s, test.addr)
+		}
+	}
+}
+
+func TestBMAddressVersions(t *testing.T) {
+	a := &BMAddress{Stream: 1}
+	copy(a.Ripe[:], []byte{0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18})
+	for _, version := range []uint64{2, 3, 4} {
+		a.Version = version
+		b, err := ParseBMAddress(a.String())
+		if err != nil {
+			t.Errorf("v%d: %s", version, err)
+			continue
+		}
+		if *b != *a {
+			t.Errorf("v%d: got %+v, expected %+v", version, b, a)
+		}
+	}
+}
+
+func TestParseBMAddressInvalid(t *testing.T) {
+	tests := []struct {
+		addr string
+		err  error
+	}{
+		{"BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUL", ErrAddressChecksum},
+		{"BM-", ErrAddressEncoding},
+		{"BM-1", ErrAddressEncoding},
+	}
+	for _, test := range tests {
+		_, err := ParseBMAddress(test.addr)
+		if err != test.err {
+			t.Errorf("%q: got %v, expected %v", test.addr, err, test.err)
+		}
+	}
+	if _, err := ParseBMAddress("BM-0OIl"); err == nil {
+		t.Error("invalid base58 was accepted")
+	}
+}
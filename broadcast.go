@@ -0,0 +1,254 @@
+package bitmessage
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+var ErrNotSubscribed = errors.New("broadcast is not from a subscribed address")
+
+// PlainBroadcast is a decrypted broadcast object
+type PlainBroadcast struct {
+	From     Sender
+	Encoding uint64
+	MessageContent
+	// ContentErr is set when Message can not be decoded with Encoding, leaving MessageContent empty
+	ContentErr error
+	Message    []byte
+	Signature  []byte
+}
+
+// signedData will return the encoded broadcast without the signature
+func (m *PlainBroadcast) signedData() []byte {
+	b := m.From.append(nil)
+	b = appendVarint(b, m.Encoding)
+	return appendVarBytes(b, m.Message)
+}
+func (m *PlainBroadcast) MarshalBinary() ([]byte, error) {
+	return appendVarBytes(m.signedData(), m.Signature), nil
+}
+func (m *PlainBroadcast) UnmarshalBinary(b []byte) error {
+	_, err := m.unmarshal(b)
+	return err
+}
+
+// unmarshal will decode a plaintext broadcast, returning the length of the signed data
+func (m *PlainBroadcast) unmarshal(b []byte) (int, error) {
+	r := &plainReader{b: b}
+	m.From.read(r)
+	m.Encoding = r.varint()
+	m.Message = r.varBytes()
+	signed := r.n
+	m.Signature = r.varBytes()
+	if r.err != nil {
+		return 0, r.err
+	}
+	m.MessageContent, m.ContentErr = MessageContent{}, nil
+	c, err := DecodeMessageContent(m.Encoding, m.Message)
+	if err != nil {
+		m.ContentErr = err
+	} else {
+		m.MessageContent = *c
+	}
+	return signed, nil
+}
+
+// Sign will sign the broadcast for an object with the given header, which includes the tag of v5 broadcasts
+func (m *PlainBroadcast) Sign(header []byte, key *btcec.PrivateKey) error {
+	sig, err := signData(key, append(append([]byte{}, header...), m.signedData()...))
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// decryptBroadcast will decrypt a broadcast from addr and verify it was signed by addr
+func decryptBroadcast(addr *BMAddress, header, encrypted []byte) (*PlainBroadcast, error) {
+	plain, err := Decrypt(addr.PrivateKey(), encrypted)
+	if err != nil {
+		return nil, err
+	}
+	m := new(PlainBroadcast)
+	signed, err := m.unmarshal(plain)
+	if err != nil {
+		return nil, err
+	}
+	if m.From.Address != *addr {
+		return nil, ErrAddressMismatch
+	}
+	err = verifySignature(m.From.SigningKey, append(append([]byte{}, header...), plain[:signed]...), m.Signature)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Decrypt will decrypt and verify a broadcast from the v2 or v3 address addr
+func (o *Broadcast4Object) Decrypt(addr *BMAddress) (*PlainBroadcast, error) {
+	return decryptBroadcast(addr, o.header, o.Encrypted)
+}
+
+// Decrypt will decrypt and verify a broadcast from the v4 address addr
+func (o *Broadcast5Object) Decrypt(addr *BMAddress) (*PlainBroadcast, error) {
+	if addr.Tag() != o.Tag {
+		return nil, ErrTagMismatch
+	}
+	return decryptBroadcast(addr, append(append([]byte{}, o.header...), o.Tag[:]...), o.Encrypted)
+}
+
+// Broadcast will publish a broadcast with the simple encoding from one of our identities to its subscribers,
+// the returned SentMessage has no recipient and goes from SendDoingPOW to SendSent.
+func (n *Node) Broadcast(from *Identity, subject, body string) (*SentMessage, error) {
+	return n.BroadcastContent(from, EncodingSimple, &MessageContent{Subject: subject, Body: body})
+}
+
+// BroadcastContent is like Broadcast, but encodes c with encoding
+func (n *Node) BroadcastContent(from *Identity, encoding uint64, c *MessageContent) (*SentMessage, error) {
+	if !n.servesStream(from.Address.Stream) {
+		return nil, ErrStreamNotServed
+	}
+	msg, err := c.Encode(encoding)
+	if err != nil {
+		return nil, err
+	}
+	m := &SentMessage{
+		From:           from,
+		Encoding:       encoding,
+		MessageContent: *c,
+		message:        msg,
+		status:         SendDoingPOW,
+		changed:        make(chan struct{}),
+	}
+	if !n.spawn(func() { n.deliverBroadcast(m) }) {
+		return nil, ErrNodeClosed
+	}
+	return m, nil
+}
+
+// deliverBroadcast will build and publish the broadcast object for m
+func (n *Node) deliverBroadcast(m *SentMessage) {
+	ctx, cancel := n.context()
+	defer cancel()
+	addr := &m.From.Address
+	obj := &ObjectMessage{
+		Expires: time.Now().Add(n.cfg.ObjectTTL),
+		Type:    ObjectTypeBroadcast,
+		Version: 4,
+		Stream:  addr.Stream,
+	}
+	header := obj.header()
+	var tag []byte
+	if addr.Version >= 4 {
+		obj.Version = 5
+		t := addr.Tag()
+		tag = t[:]
+		header = append(obj.header(), tag...)
+	}
+	pb := &PlainBroadcast{
+		From:     m.From.sender(),
+		Encoding: m.Encoding,
+		Message:  m.message,
+	}
+	err := pb.Sign(header, m.From.SigningKey)
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		return
+	}
+	plain, err := pb.MarshalBinary()
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		return
+	}
+	enc, err := Encrypt(addr.PrivateKey().PubKey(), plain)
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		return
+	}
+	obj.Payload = append(tag, enc...)
+	err = obj.DoPOW(ctx, n.cfg.POWEngine, NetworkPOWParams)
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		return
+	}
+	v, err := n.publish(obj)
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		return
+	}
+	m.mx.Lock()
+	m.vector = v
+	m.mx.Unlock()
+	m.setStatus(SendSent, nil)
+}
+
+// Subscribe will deliver broadcasts from addr to Config.OnBroadcast
+func (n *Node) Subscribe(addr *BMAddress) {
+	n.submx.Lock()
+	n.subs[*addr] = true
+	n.submx.Unlock()
+}
+
+// Unsubscribe will stop delivering broadcasts from addr
+func (n *Node) Unsubscribe(addr *BMAddress) {
+	n.submx.Lock()
+	delete(n.subs, *addr)
+	n.submx.Unlock()
+}
+
+// Subscriptions will return the addresses we receive broadcasts from
+func (n *Node) Subscriptions() []BMAddress {
+	n.submx.Lock()
+	defer n.submx.Unlock()
+	subs := make([]BMAddress, 0, len(n.subs))
+	for a := range n.subs {
+		subs = append(subs, a)
+	}
+	return subs
+}
+
+// decryptSubscribed will decrypt a broadcast object from one of our subscriptions
+func (n *Node) decryptSubscribed(o interface{}) (*PlainBroadcast, error) {
+	for _, a := range n.Subscriptions() {
+		switch b := o.(type) {
+		case *Broadcast4Object:
+			if a.Version >= 4 {
+				continue
+			}
+			m, err := b.Decrypt(&a)
+			if err == ErrInvalidMAC {
+				continue
+			}
+			return m, err
+		case *Broadcast5Object:
+			if a.Version < 4 || a.Tag() != b.Tag {
+				continue
+			}
+			return b.Decrypt(&a)
+		}
+	}
+	return nil, ErrNotSubscribed
+}
+
+// broadcastReceived will deliver a broadcast object to Config.OnBroadcast if it is from a subscription
+func (n *Node) broadcastReceived(m *ObjectMessage) {
+	o, err := m.Decode()
+	if err != nil {
+		log.Debugln("ignoring broadcast:", err)
+		return
+	}
+	b, err := n.decryptSubscribed(o)
+	if err == ErrNotSubscribed {
+		return
+	}
+	if err != nil {
+		log.Warnln("invalid broadcast:", err)
+		return
+	}
+	log.Infoln("broadcast from", b.From.Address.String())
+	if n.cfg.OnBroadcast != nil {
+		n.cfg.OnBroadcast(b)
+	}
+}
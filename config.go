@@ -0,0 +1,124 @@
+package bitmessage
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	DefaultListenAddr     = ":8444"
+	DefaultMaxConnections = 100
+	DefaultMessageBuffer  = 5
+)
+
+// Dialer is used to make outgoing connections, *net.Dialer satisfies it. Dials are cancelled when the Node is closed.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Config holds the options of a Node, zero values are replaced with the package defaults
+type Config struct {
+	// ListenAddr is the address to listen on when Listener is nil
+	ListenAddr string
+	// Listener accepts incoming connections, it is closed along with the Node
+	Listener net.Listener
+	// Dialer makes outgoing connections, defaults to a net.Dialer with a HandshakeTimeout timeout
+	Dialer Dialer
+
+	UserAgent       string
+	ProtocolVersion int32
+	Streams         []uint64
+
+	NodeTimeout       time.Duration
+	HandshakeTimeout  time.Duration
+	ConnectionTimeout time.Duration
+	GetDataInterval   time.Duration
+	RelayInterval     time.Duration
+
+	// MaxConnections limits the number of connected peers, incoming connections past it are refused
+	MaxConnections int
+	// OutboundConnections is the number of outgoing connections to maintain per stream, negative disables them
+	OutboundConnections int
+	// BootstrapNodes are dialed when there are not enough known nodes, nil uses DefaultBootstrapNodes
+	BootstrapNodes []string
+
+	// BanThreshold is the misbehavior score at which a peer is disconnected and banned for BanDuration
+	BanThreshold int
+	BanDuration  time.Duration
+
+	// InboundBuffer and OutboundBuffer are the number of messages buffered per connection
+	InboundBuffer  int
+	OutboundBuffer int
+
+	// POWEngine does the proof of work of objects we create, nil uses every CPU
+	POWEngine *POWEngine
+	// ObjectTTL is how long objects we create live for
+	ObjectTTL time.Duration
+
+	// OnBroadcast is called with broadcasts from subscribed addresses, it should not block for long
+	OnBroadcast func(*PlainBroadcast)
+	// OnMessage is called with messages to our identities, it should not block for long
+	OnMessage func(*PlainMessage)
+}
+
+func (c Config) withDefaults() Config {
+	if c.ListenAddr == "" {
+		c.ListenAddr = DefaultListenAddr
+	}
+	if c.UserAgent == "" {
+		c.UserAgent = UserAgent
+	}
+	if c.ProtocolVersion == 0 {
+		c.ProtocolVersion = Version
+	}
+	if len(c.Streams) == 0 {
+		c.Streams = []uint64{1}
+	}
+	if c.NodeTimeout == 0 {
+		c.NodeTimeout = NodeTimeout
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = HandshakeTimeout
+	}
+	if c.ConnectionTimeout == 0 {
+		c.ConnectionTimeout = ConnectionTimeout
+	}
+	if c.GetDataInterval == 0 {
+		c.GetDataInterval = GetDataInterval
+	}
+	if c.RelayInterval == 0 {
+		c.RelayInterval = RelayInterval
+	}
+	if c.Dialer == nil {
+		c.Dialer = &net.Dialer{Timeout: c.HandshakeTimeout}
+	}
+	if c.MaxConnections == 0 {
+		c.MaxConnections = DefaultMaxConnections
+	}
+	if c.OutboundConnections == 0 {
+		c.OutboundConnections = DefaultOutboundConnections
+	}
+	if c.BootstrapNodes == nil {
+		c.BootstrapNodes = DefaultBootstrapNodes
+	}
+	if c.BanThreshold == 0 {
+		c.BanThreshold = DefaultBanThreshold
+	}
+	if c.BanDuration == 0 {
+		c.BanDuration = DefaultBanDuration
+	}
+	if c.InboundBuffer == 0 {
+		c.InboundBuffer = DefaultMessageBuffer
+	}
+	if c.OutboundBuffer == 0 {
+		c.OutboundBuffer = DefaultMessageBuffer
+	}
+	if c.POWEngine == nil {
+		c.POWEngine = &POWEngine{}
+	}
+	if c.ObjectTTL == 0 {
+		c.ObjectTTL = DefaultObjectTTL
+	}
+	return c
+}
@@ -0,0 +1,290 @@
+package bitmessage
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultOutboundConnections = 8
+	DialBackoffMin             = time.Second * 30
+	DialBackoffMax             = time.Hour
+	ConnectInterval            = time.Second * 10
+	// BootstrapResolveInterval is how long resolved bootstrap node addresses are cached
+	BootstrapResolveInterval = time.Minute * 30
+	// BootstrapResolveTimeout limits each DNS lookup of a bootstrap node
+	BootstrapResolveTimeout = time.Second * 10
+)
+
+// DefaultBootstrapNodes are dialed when there are not enough known nodes to reach the outbound target
+var DefaultBootstrapNodes = []string{
+	"bootstrap8444.bitmessage.org:8444",
+	"bootstrap8080.bitmessage.org:8080",
+}
+
+type dialState struct {
+	failures uint
+	next     time.Time
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+type dialCandidate struct {
+	addr   string
+	ip     net.IP
+	stream uint64
+	known  *KnownNode
+}
+
+// connManager will keep the node connected to a target number of outbound peers per stream
+type connManager struct {
+	n         *Node
+	target    int
+	bootstrap []string
+	wake      chan struct{}
+
+	mx       sync.Mutex
+	pending  map[string]dialCandidate
+	backoff  map[string]*dialState
+	resolved map[string]resolvedHost
+}
+
+func newConnManager(n *Node, target int, bootstrap []string) *connManager {
+	return &connManager{
+		n:         n,
+		target:    target,
+		bootstrap: bootstrap,
+		wake:      make(chan struct{}, 1),
+		pending:   make(map[string]dialCandidate),
+		backoff:   make(map[string]*dialState),
+		resolved:  make(map[string]resolvedHost),
+	}
+}
+
+// wakeUp will trigger a check of outbound connections, e.g. after a peer disconnects
+func (m *connManager) wakeUp() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *connManager) run() {
+	if m.target <= 0 {
+		return
+	}
+	t := time.NewTicker(ConnectInterval)
+	defer t.Stop()
+	for {
+		m.fill()
+		select {
+		case <-m.n.quit:
+			return
+		case <-t.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// netGroup will return the /16 of an IPv4 address, or the /32 of an IPv6 address
+func netGroup(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:2])
+	}
+	return string(ip.To16()[:4])
+}
+
+// fill will dial new peers for every stream below the outbound target
+func (m *connManager) fill() {
+	groups := make(map[string]bool)
+	counts := make(map[uint64]int)
+	m.n.poolmx.RLock()
+	for _, c := range m.n.pool {
+		if !c.outgoing {
+			continue
+		}
+		if a, ok := c.c.RemoteAddr().(*net.TCPAddr); ok {
+			groups[netGroup(a.IP)] = true
+		}
+		for _, s := range c.streams {
+			counts[s]++
+		}
+	}
+	m.n.poolmx.RUnlock()
+
+	m.mx.Lock()
+	for _, p := range m.pending {
+		groups[netGroup(p.ip)] = true
+		counts[p.stream]++
+	}
+	m.pruneBackoff(time.Now())
+	m.mx.Unlock()
+
+	for _, s := range m.n.streams {
+		need := m.target - counts[s]
+		if need <= 0 {
+			continue
+		}
+		for _, cand := range m.candidates(s, groups) {
+			if need == 0 {
+				break
+			}
+			g := netGroup(cand.ip)
+			if groups[g] {
+				continue
+			}
+			groups[g] = true
+			need--
+			m.dial(cand)
+		}
+	}
+}
+
+// candidates will return dialable addresses for a stream, known nodes in random order followed by bootstrap nodes
+func (m *connManager) candidates(stream uint64, groups map[string]bool) []dialCandidate {
+	nodes, err := m.n.known.ListKnownNodes(uint32(stream))
+	if err != nil {
+		log.Warnln("failed to list known nodes:", err)
+	}
+	now := time.Now()
+	var result []dialCandidate
+	add := func(c dialCandidate) {
+		if groups[netGroup(c.ip)] || m.n.bans.Banned(c.ip) {
+			return
+		}
+		m.mx.Lock()
+		b := m.backoff[c.addr]
+		_, pending := m.pending[c.addr]
+		m.mx.Unlock()
+		if pending || (b != nil && now.Before(b.next)) {
+			return
+		}
+		result = append(result, c)
+	}
+	for _, i := range rand.Perm(len(nodes)) {
+		k := nodes[i]
+		add(dialCandidate{
+			addr:   net.JoinHostPort(k.IP.String(), strconv.Itoa(int(k.Port))),
+			ip:     k.IP,
+			stream: stream,
+			known:  &k,
+		})
+	}
+	if len(result) >= m.target {
+		return result
+	}
+	for _, b := range m.bootstrap {
+		host, port, err := net.SplitHostPort(b)
+		if err != nil {
+			log.Warnln("invalid bootstrap node:", err)
+			continue
+		}
+		for _, ip := range m.resolve(host) {
+			add(dialCandidate{addr: net.JoinHostPort(ip.String(), port), ip: ip, stream: stream})
+		}
+	}
+	return result
+}
+
+// resolve will return the addresses of a bootstrap host, cached for BootstrapResolveInterval.
+// Failed lookups are retried after DialBackoffMin, and lookups are cancelled when the node is closed.
+func (m *connManager) resolve(host string) []net.IP {
+	now := time.Now()
+	m.mx.Lock()
+	r, ok := m.resolved[host]
+	m.mx.Unlock()
+	if ok && now.Before(r.expires) {
+		return r.ips
+	}
+	ctx, cancel := m.n.context()
+	defer cancel()
+	ctx, cancelTimeout := context.WithTimeout(ctx, BootstrapResolveTimeout)
+	defer cancelTimeout()
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	r = resolvedHost{ips: ips, expires: now.Add(BootstrapResolveInterval)}
+	if err != nil {
+		log.Warnln("failed to resolve bootstrap node:", err)
+		r.expires = now.Add(DialBackoffMin)
+	}
+	m.mx.Lock()
+	m.resolved[host] = r
+	m.mx.Unlock()
+	return r.ips
+}
+
+func (m *connManager) dial(cand dialCandidate) {
+	m.mx.Lock()
+	m.pending[cand.addr] = cand
+	m.mx.Unlock()
+	ok := m.n.spawn(func() {
+		ctx, cancel := m.n.context()
+		conn, err := m.n.cfg.Dialer.DialContext(ctx, "tcp", cand.addr)
+		cancel()
+		if err != nil {
+			log.Infoln("dial failed:", err)
+			m.dialDone(cand.addr, err)
+			return
+		}
+		m.n.handle(conn, cand.addr)
+	})
+	if !ok {
+		m.mx.Lock()
+		delete(m.pending, cand.addr)
+		m.mx.Unlock()
+	}
+}
+
+// pruneBackoff will forget addresses whose backoff ended more than DialBackoffMax before now. Addresses that
+// are dialed again sooner keep their failure count, so their backoff still grows. m.mx must be held.
+func (m *connManager) pruneBackoff(now time.Time) {
+	for addr, b := range m.backoff {
+		if now.After(b.next.Add(DialBackoffMax)) {
+			delete(m.backoff, addr)
+		}
+	}
+}
+
+// dialDone will record the result of connecting and handshaking with addr
+func (m *connManager) dialDone(addr string, err error) {
+	m.mx.Lock()
+	cand, ok := m.pending[addr]
+	delete(m.pending, addr)
+	if err == nil {
+		delete(m.backoff, addr)
+		m.mx.Unlock()
+		return
+	}
+	b := m.backoff[addr]
+	if b == nil {
+		b = new(dialState)
+		m.backoff[addr] = b
+	}
+	b.failures++
+	delay := DialBackoffMax
+	if b.failures < 16 {
+		delay = DialBackoffMin << (b.failures - 1)
+	}
+	if delay > DialBackoffMax {
+		delay = DialBackoffMax
+	}
+	b.next = time.Now().Add(delay)
+	m.mx.Unlock()
+
+	if !ok || cand.known == nil {
+		return
+	}
+	err = m.n.updateKnownNode(cand.known.FullAddress, func(k *KnownNode) {
+		k.Failures++
+	})
+	if err != nil {
+		log.Warnln("failed to record known node failure:", err)
+	}
+}
@@ -1,6 +1,7 @@
 package bitmessage
 
 import (
+	"bytes"
 	"github.com/boltdb/bolt"
 	"os"
 )
@@ -13,7 +14,47 @@ type Store interface {
 	Close() error
 }
 
+// KnownNodeStore is implemented by a Store that can persist known nodes, otherwise a Node keeps them in memory
+type KnownNodeStore interface {
+	SaveKnownNode(*KnownNode) error
+	GetKnownNode(stream uint32, a Address) (*KnownNode, error)
+	DeleteKnownNode(*KnownNode) error
+	ListKnownNodes(stream uint32) ([]KnownNode, error)
+}
+
+// PubKeyStore is implemented by a Store that can persist pubkeys after their objects expire, otherwise a Node keeps them in memory.
+// ListPubKeys returns every key starting with prefix.
+type PubKeyStore interface {
+	SavePubKey(key, data []byte) error
+	GetPubKey(key []byte) ([]byte, error)
+	DeletePubKey(key []byte) error
+	ListPubKeys(prefix []byte) ([][]byte, error)
+}
+
+// SendStore is implemented by a Store that can persist messages being sent by their ack data, so delivery
+// resumes after a restart. Otherwise a Node keeps them in memory.
+type SendStore interface {
+	SaveSend(ackData, data []byte) error
+	DeleteSend(ackData []byte) error
+	ListSends() ([][]byte, error)
+}
+
+// Syncer is implemented by a Store that buffers writes, Node.Close calls Sync to flush them
+type Syncer interface {
+	Sync() error
+}
+
 var objectBucket = []byte("object_storage")
+var knownNodeBucket = []byte("known_nodes")
+
+// pubKeyBucket holds pubkey objects by the ripe (v2, v3) or tag and inventory vector (v4) of their address
+var pubKeyBucket = []byte("pubkeys")
+
+// sendBucket holds messages being sent by their ack data
+var sendBucket = []byte("sends")
+
+// objectStreamBucket was an unused index of objects by stream, it is removed from existing databases
+var objectStreamBucket = []byte("object_streams")
 
 type FileStore struct {
 	db *bolt.DB
@@ -29,6 +70,21 @@ func NewFileStore(file string, mode os.FileMode) (*FileStore, error) {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(knownNodeBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(pubKeyBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(sendBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(objectStreamBucket) != nil {
+			return tx.DeleteBucket(objectStreamBucket)
+		}
 		return nil
 	})
 	if err != nil {
@@ -41,13 +97,13 @@ func NewFileStore(file string, mode os.FileMode) (*FileStore, error) {
 func (fs *FileStore) Close() error {
 	return fs.db.Close()
 }
+func (fs *FileStore) Sync() error {
+	return fs.db.Sync()
+}
+
 func (fs *FileStore) DeleteObject(v InvVector) error {
 	return fs.db.Update(func(tx *bolt.Tx) error {
-		bk := tx.Bucket(objectBucket)
-		if bk == nil {
-			return nil
-		}
-		return bk.Delete(v[:])
+		return tx.Bucket(objectBucket).Delete(v[:])
 	})
 }
 func (fs *FileStore) SaveObject(v InvVector, data []byte) error {
@@ -63,7 +119,13 @@ func (fs *FileStore) GetObject(v InvVector) ([]byte, error) {
 	var data []byte
 	err := fs.db.View(func(tx *bolt.Tx) error {
 		bk := tx.Bucket(objectBucket)
-		data = bk.Get(v[:])
+		val := bk.Get(v[:])
+		if val == nil {
+			return nil
+		}
+		// bolt values are only valid for the life of the transaction
+		data = make([]byte, len(val))
+		copy(data, val)
 		return nil
 	})
 	return data, err
@@ -82,3 +144,113 @@ func (fs *FileStore) ListObjects() ([]InvVector, error) {
 	})
 	return result, err
 }
+
+func (fs *FileStore) SaveKnownNode(k *KnownNode) error {
+	data, err := k.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(knownNodeBucket)
+		if err != nil {
+			return err
+		}
+		return bk.Put(k.key(), data)
+	})
+}
+func (fs *FileStore) GetKnownNode(stream uint32, a Address) (*KnownNode, error) {
+	var k *KnownNode
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(knownNodeBucket)
+		data := bk.Get((&KnownNode{FullAddress: FullAddress{Stream: stream, Address: a}}).key())
+		if data == nil {
+			return nil
+		}
+		k = new(KnownNode)
+		return k.UnmarshalBinary(data)
+	})
+	return k, err
+}
+func (fs *FileStore) DeleteKnownNode(k *KnownNode) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(knownNodeBucket)
+		if bk == nil {
+			return nil
+		}
+		return bk.Delete(k.key())
+	})
+}
+func (fs *FileStore) ListKnownNodes(stream uint32) ([]KnownNode, error) {
+	var result []KnownNode
+	prefix := make([]byte, 4)
+	order.PutUint32(prefix, stream)
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(knownNodeBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var kn KnownNode
+			err := kn.UnmarshalBinary(v)
+			if err != nil {
+				return err
+			}
+			result = append(result, kn)
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (fs *FileStore) SavePubKey(key, data []byte) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pubKeyBucket).Put(key, data)
+	})
+}
+func (fs *FileStore) GetPubKey(key []byte) ([]byte, error) {
+	var data []byte
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(pubKeyBucket).Get(key)
+		if val == nil {
+			return nil
+		}
+		data = make([]byte, len(val))
+		copy(data, val)
+		return nil
+	})
+	return data, err
+}
+func (fs *FileStore) DeletePubKey(key []byte) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pubKeyBucket).Delete(key)
+	})
+}
+func (fs *FileStore) ListPubKeys(prefix []byte) ([][]byte, error) {
+	var result [][]byte
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(pubKeyBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			result = append(result, append([]byte{}, k...))
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (fs *FileStore) SaveSend(ackData, data []byte) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sendBucket).Put(ackData, data)
+	})
+}
+func (fs *FileStore) DeleteSend(ackData []byte) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sendBucket).Delete(ackData)
+	})
+}
+func (fs *FileStore) ListSends() ([][]byte, error) {
+	var result [][]byte
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sendBucket).ForEach(func(k, v []byte) error {
+			result = append(result, append([]byte{}, v...))
+			return nil
+		})
+	})
+	return result, err
+}
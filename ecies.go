@@ -0,0 +1,158 @@
+package bitmessage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"io"
+	"math/big"
+)
+
+// eciesCurveSecp256k1 is the OpenSSL curve id written before encoded public keys
+const eciesCurveSecp256k1 = 714
+
+var ErrInvalidMAC = errors.New("invalid message authentication code")
+var ErrInvalidPadding = errors.New("invalid padding")
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+var ErrUnsupportedCurve = errors.New("unsupported curve")
+
+// padBytes will left-pad b with zeros to size
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
+
+// ecdhKeys will derive the encryption and MAC keys from the shared X coordinate of priv*pub
+func ecdhKeys(priv *btcec.PrivateKey, pub *btcec.PublicKey) (keyE, keyM []byte) {
+	x, _ := btcec.S256().ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	h := sha512.Sum512(padBytes(x.Bytes(), 32))
+	return h[:32], h[32:]
+}
+
+// encodeECIESPubKey will encode pub as curve type, X length, X, Y length, Y
+func encodeECIESPubKey(pub *btcec.PublicKey) []byte {
+	b := make([]byte, 70)
+	order.PutUint16(b, eciesCurveSecp256k1)
+	order.PutUint16(b[2:], 32)
+	copy(b[4:], padBytes(pub.X.Bytes(), 32))
+	order.PutUint16(b[36:], 32)
+	copy(b[38:], padBytes(pub.Y.Bytes(), 32))
+	return b
+}
+
+// decodeECIESPubKey will decode a public key written by encodeECIESPubKey, returning the number of bytes read
+func decodeECIESPubKey(b []byte) (*btcec.PublicKey, int, error) {
+	if len(b) < 4 {
+		return nil, 0, ErrInvalidCiphertext
+	}
+	if order.Uint16(b) != eciesCurveSecp256k1 {
+		return nil, 0, ErrUnsupportedCurve
+	}
+	p := 2
+	coord := func() (*big.Int, error) {
+		if len(b) < p+2 {
+			return nil, ErrInvalidCiphertext
+		}
+		l := int(order.Uint16(b[p:]))
+		p += 2
+		if l > 32 || len(b) < p+l {
+			return nil, ErrInvalidCiphertext
+		}
+		v := new(big.Int).SetBytes(b[p : p+l])
+		p += l
+		return v, nil
+	}
+	x, err := coord()
+	if err != nil {
+		return nil, 0, err
+	}
+	y, err := coord()
+	if err != nil {
+		return nil, 0, err
+	}
+	if !btcec.S256().IsOnCurve(x, y) {
+		return nil, 0, ErrInvalidCiphertext
+	}
+	return &btcec.PublicKey{Curve: btcec.S256(), X: x, Y: y}, p, nil
+}
+
+// Encrypt will encrypt plaintext to pub with the Bitmessage ECIES scheme. The result is
+// IV, ephemeral public key, AES-256-CBC ciphertext and an HMAC-SHA256 over all of them.
+func Encrypt(pub *btcec.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	keyE, keyM := ecdhKeys(ephemeral, pub)
+
+	pad := aes.BlockSize - len(plaintext)%aes.BlockSize
+	padded := make([]byte, len(plaintext)+pad)
+	copy(padded, plaintext)
+	for i := len(plaintext); i < len(padded); i++ {
+		padded[i] = byte(pad)
+	}
+
+	b := make([]byte, aes.BlockSize, aes.BlockSize+70+len(padded)+sha256.Size)
+	_, err = io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, encodeECIESPubKey(ephemeral.PubKey())...)
+	block, err := aes.NewCipher(keyE)
+	if err != nil {
+		return nil, err
+	}
+	ct := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, b[:aes.BlockSize]).CryptBlocks(ct, padded)
+	b = append(b, ct...)
+
+	mac := hmac.New(sha256.New, keyM)
+	mac.Write(b)
+	return mac.Sum(b), nil
+}
+
+// Decrypt will decrypt data encrypted by Encrypt to the public key of priv
+func Decrypt(priv *btcec.PrivateKey, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize+sha256.Size {
+		return nil, ErrInvalidCiphertext
+	}
+	body := data[:len(data)-sha256.Size]
+	pub, n, err := decodeECIESPubKey(body[aes.BlockSize:])
+	if err != nil {
+		return nil, err
+	}
+	ct := body[aes.BlockSize+n:]
+	if len(ct) == 0 || len(ct)%aes.BlockSize != 0 {
+		return nil, ErrInvalidCiphertext
+	}
+	keyE, keyM := ecdhKeys(priv, pub)
+
+	mac := hmac.New(sha256.New, keyM)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), data[len(body):]) {
+		return nil, ErrInvalidMAC
+	}
+
+	block, err := aes.NewCipher(keyE)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(ct))
+	cipher.NewCBCDecrypter(block, body[:aes.BlockSize]).CryptBlocks(plain, ct)
+
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize || !bytes.Equal(plain[len(plain)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrInvalidPadding
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,76 @@
+package bitmessage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/btcsuite/btcd/btcec"
+	"testing"
+)
+
+func TestECIESRoundTrip(t *testing.T) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []int{0, 1, 15, 16, 17, 1000} {
+		plaintext := bytes.Repeat([]byte{'a'}, l)
+		data, err := Encrypt(key.PubKey(), plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Decrypt(key, data)
+		if err != nil {
+			t.Errorf("%d bytes: %s", l, err)
+		} else if !bytes.Equal(result, plaintext) {
+			t.Errorf("%d bytes: got %x, expected %x", l, result, plaintext)
+		}
+		if _, err := Decrypt(other, data); err != ErrInvalidMAC {
+			t.Errorf("%d bytes, wrong key: got %v, expected %v", l, err, ErrInvalidMAC)
+		}
+	}
+}
+
+func TestECIESTampered(t *testing.T) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Encrypt(key.PubKey(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// IV, ciphertext and MAC, the ephemeral key is checked against the curve first
+	for _, i := range []int{0, len(data) - 40, len(data) - 1} {
+		tampered := append([]byte(nil), data...)
+		tampered[i] ^= 1
+		if _, err := Decrypt(key, tampered); err != ErrInvalidMAC {
+			t.Errorf("byte %d: got %v, expected %v", i, err, ErrInvalidMAC)
+		}
+	}
+	if _, err := Decrypt(key, data[:20]); err != ErrInvalidCiphertext {
+		t.Errorf("truncated: got %v, expected %v", err, ErrInvalidCiphertext)
+	}
+}
+
+// TestECIESVector decrypts data built independently with the OpenSSL primitives pyelliptic wraps:
+// ECDH, SHA-512 of the shared X split into AES-256-CBC and HMAC-SHA256 keys.
+func TestECIESVector(t *testing.T) {
+	d, _ := hex.DecodeString("5dc0bbd3b5ab82ad9cfd2b1a2b06a0e2bb62b55d94d8b0b0c8d5e3cbb3e4a4a1")
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), d)
+	data, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f" +
+		"02ca0020ae0bee91227ceb194f67ec90be4d3c644bcf9071434ba8ba2451f722052367400020" +
+		"0df19adcd400b20c567f632d1a2d46d48eb0109a815b0dc45a4b389eb38e1554" +
+		"ab188d11e3193bd55a80e2247dd0a56ceaab35cf51eb9ce09ff4d27d8df5ac03400809b671d6202384f8b48f4d30964e" +
+		"dd85cfa5c14dfec8e7d73fcfd6f6a882103e4b5e81f140a3cc513005f76f04d7")
+	result, err := Decrypt(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(result); s != "The quick brown fox jumps over the lazy dog" {
+		t.Errorf("got %q", s)
+	}
+}
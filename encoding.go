@@ -0,0 +1,191 @@
+package bitmessage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	EncodingIgnore   = 0
+	EncodingTrivial  = 1
+	EncodingSimple   = 2
+	EncodingExtended = 3
+
+	// MaxSubjectLength is the number of characters of a subject that are kept
+	MaxSubjectLength = 500
+	// MaxExtendedLength is the largest decompressed extended encoding accepted, larger ones are rejected as decompression bombs
+	MaxExtendedLength = 1 << 20
+	// extendedTypeMessage is the extended encoding object type of person-to-person messages and broadcasts
+	extendedTypeMessage = "message"
+)
+
+var ErrUnknownEncoding = errors.New("unknown message encoding")
+var ErrExtendedTooLarge = errors.New("extended message is larger than maximum allowed")
+var ErrInvalidExtended = errors.New("invalid extended message")
+
+// MessageFile is a file attached to a message with the extended encoding
+type MessageFile struct {
+	Name string
+	Data []byte
+	// Type is the MIME type of Data
+	Type string
+	// Disposition is "inline" or "attachment"
+	Disposition string
+}
+
+// MessageContent is the decoded content of a msg or broadcast, only the extended encoding has Files
+type MessageContent struct {
+	Subject string
+	Body    string
+	Files   []MessageFile
+}
+
+// Encode will encode the content with encoding, the trivial encoding only includes the body
+func (c *MessageContent) Encode(encoding uint64) ([]byte, error) {
+	switch encoding {
+	case EncodingIgnore:
+		return nil, nil
+	case EncodingTrivial:
+		return []byte(c.Body), nil
+	case EncodingSimple:
+		return []byte("Subject:" + c.Subject + "\nBody:" + c.Body), nil
+	case EncodingExtended:
+		return c.encodeExtended()
+	}
+	return nil, ErrUnknownEncoding
+}
+
+// DecodeMessageContent will decode a message with encoding, the ignore encoding and unknown encodings return empty content
+func DecodeMessageContent(encoding uint64, msg []byte) (*MessageContent, error) {
+	c := new(MessageContent)
+	switch encoding {
+	case EncodingTrivial:
+		c.Body = validString(msg)
+	case EncodingSimple:
+		s := validString(msg)
+		i := strings.Index(s, "\nBody:")
+		if i < 8 || !strings.HasPrefix(s, "Subject:") {
+			c.Body = s
+			break
+		}
+		c.Subject, c.Body = truncateSubject(s[8:i]), s[i+6:]
+	case EncodingExtended:
+		err := c.decodeExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func validString(b []byte) string {
+	return string(bytes.ToValidUTF8(b, []byte("�")))
+}
+
+func truncateSubject(s string) string {
+	if r := []rune(s); len(r) > MaxSubjectLength {
+		return string(r[:MaxSubjectLength])
+	}
+	return s
+}
+
+// encodeExtended will encode the content as a zlib compressed msgpack map
+func (c *MessageContent) encodeExtended() ([]byte, error) {
+	m := map[string]interface{}{
+		"":        extendedTypeMessage,
+		"subject": c.Subject,
+		"body":    c.Body,
+	}
+	if len(c.Files) > 0 {
+		files := make([]map[string]interface{}, len(c.Files))
+		for i, f := range c.Files {
+			files[i] = map[string]interface{}{
+				"name":        f.Name,
+				"data":        f.Data,
+				"type":        f.Type,
+				"disposition": f.Disposition,
+			}
+		}
+		m["files"] = files
+	}
+	data, err := msgpack.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeExtended will decode a zlib compressed msgpack map, at most MaxExtendedLength bytes are decompressed
+func (c *MessageContent) decodeExtended(msg []byte) error {
+	r, err := zlib.NewReader(bytes.NewReader(msg))
+	if err != nil {
+		return ErrInvalidExtended
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxExtendedLength+1))
+	if err != nil {
+		return ErrInvalidExtended
+	}
+	if len(data) > MaxExtendedLength {
+		return ErrExtendedTooLarge
+	}
+	var m map[string]interface{}
+	err = msgpack.Unmarshal(data, &m)
+	if err != nil {
+		return ErrInvalidExtended
+	}
+	if msgpackString(m[""]) != extendedTypeMessage {
+		return ErrUnknownEncoding
+	}
+	c.Subject = truncateSubject(msgpackString(m["subject"]))
+	c.Body = msgpackString(m["body"])
+	files, _ := m["files"].([]interface{})
+	for _, v := range files {
+		f, ok := v.(map[string]interface{})
+		if !ok {
+			return ErrInvalidExtended
+		}
+		c.Files = append(c.Files, MessageFile{
+			Name:        msgpackString(f["name"]),
+			Data:        msgpackBytes(f["data"]),
+			Type:        msgpackString(f["type"]),
+			Disposition: msgpackString(f["disposition"]),
+		})
+	}
+	return nil
+}
+
+// msgpackString will return v as a string, older encoders write strings as raw bytes
+func msgpackString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return validString(s)
+	}
+	return ""
+}
+func msgpackBytes(v interface{}) []byte {
+	switch b := v.(type) {
+	case []byte:
+		return b
+	case string:
+		return []byte(b)
+	}
+	return nil
+}
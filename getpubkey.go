@@ -0,0 +1,112 @@
+package bitmessage
+
+import (
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// pubKeyObject will build the signed pubkey object of the identity, without POW
+func (id *Identity) pubKeyObject(expires time.Time) (*ObjectMessage, error) {
+	obj := &ObjectMessage{
+		Expires: expires,
+		Type:    ObjectTypePubKey,
+		Version: id.Address.Version,
+		Stream:  id.Address.Stream,
+	}
+	s := id.sender()
+	p2 := PubKey2Object{Behavior: s.Behavior, SigningKey: s.SigningKey, EncryptionKey: s.EncryptionKey}
+	p3 := PubKey3Object{PubKey2Object: p2, NonceTrialsPerByte: s.NonceTrialsPerByte, ExtraBytes: s.ExtraBytes}
+	var err error
+	switch id.Address.Version {
+	case 2:
+		obj.Payload, err = p2.MarshalBinary()
+	case 3:
+		err = p3.Sign(obj.header(), id.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		obj.Payload, err = p3.MarshalBinary()
+	case 4:
+		p4 := &PubKey4Object{PubKey3Object: p3}
+		err = p4.Seal(obj.header(), &id.Address, id.SigningKey)
+		if err != nil {
+			return nil, err
+		}
+		obj.Payload, err = p4.MarshalBinary()
+	default:
+		return nil, ErrAddressVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// requestedIdentity will return our identity a getpubkey object asks for, or nil
+func (n *Node) requestedIdentity(m *ObjectMessage) *Identity {
+	o, err := m.Decode()
+	if err != nil {
+		log.Debugln("ignoring getpubkey:", err)
+		return nil
+	}
+	for _, id := range n.Identities() {
+		if id.Address.Version != m.Version || id.Address.Stream != m.Stream {
+			continue
+		}
+		switch g := o.(type) {
+		case *GetPubKeyOldObject:
+			if g.Ripe == id.Address.Ripe {
+				return id
+			}
+		case *GetPubKeyObject:
+			if g.Tag == id.Address.Tag() {
+				return id
+			}
+		}
+	}
+	return nil
+}
+
+// getPubKeyReceived will publish our pubkey in answer to a getpubkey object, unless the last one we published has not expired
+func (n *Node) getPubKeyReceived(m *ObjectMessage) {
+	id := n.requestedIdentity(m)
+	if id == nil {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(n.cfg.ObjectTTL)
+	n.idmx.Lock()
+	if n.pubKeySent[id.Address].After(now) {
+		n.idmx.Unlock()
+		log.Debugln("pubkey for", id.Address.String(), "was published recently, not answering request")
+		return
+	}
+	n.pubKeySent[id.Address] = expires
+	n.idmx.Unlock()
+	n.spawn(func() {
+		err := n.publishPubKey(id, expires)
+		if err != nil {
+			log.Warnln("failed to publish pubkey for", id.Address.String()+":", err)
+			n.idmx.Lock()
+			delete(n.pubKeySent, id.Address)
+			n.idmx.Unlock()
+		}
+	})
+}
+
+// publishPubKey will do the POW of the pubkey object of id and publish it
+func (n *Node) publishPubKey(id *Identity, expires time.Time) error {
+	ctx, cancel := n.context()
+	defer cancel()
+	obj, err := id.pubKeyObject(expires)
+	if err != nil {
+		return err
+	}
+	log.Infoln("publishing pubkey for", id.Address.String())
+	err = obj.DoPOW(ctx, n.cfg.POWEngine, NetworkPOWParams)
+	if err != nil {
+		return err
+	}
+	_, err = n.publish(obj)
+	return err
+}
@@ -0,0 +1,145 @@
+package bitmessage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const (
+	// DefaultRipeZeroBytes is the number of leading zero bytes required of a new identity's ripe,
+	// each extra byte makes the address one character shorter and takes 256 times longer to find
+	DefaultRipeZeroBytes = 1
+)
+
+var ErrInvalidWIF = errors.New("invalid WIF private key")
+
+// Identity is one of our addresses, with its private keys
+type Identity struct {
+	Address       BMAddress
+	SigningKey    *btcec.PrivateKey
+	EncryptionKey *btcec.PrivateKey
+	// SuppressAcks stops the node from publishing acks for messages to the identity, and its pubkey from advertising them
+	SuppressAcks bool
+}
+
+// NewIdentity will create an identity from existing private keys
+func NewIdentity(version, stream uint64, signingKey, encryptionKey *btcec.PrivateKey) *Identity {
+	return &Identity{
+		Address:       *NewBMAddress(version, stream, signingKey.PubKey(), encryptionKey.PubKey()),
+		SigningKey:    signingKey,
+		EncryptionKey: encryptionKey,
+	}
+}
+
+func hasZeroPrefix(ripe [20]byte, zeroBytes int) bool {
+	for _, b := range ripe[:zeroBytes] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRandomIdentity will generate an identity from random keys, whose ripe starts with zeroBytes zero bytes
+func NewRandomIdentity(version, stream uint64, zeroBytes int) (*Identity, error) {
+	sign, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		enc, err := btcec.NewPrivateKey(btcec.S256())
+		if err != nil {
+			return nil, err
+		}
+		if hasZeroPrefix(CalcRipe(sign.PubKey(), enc.PubKey()), zeroBytes) {
+			return NewIdentity(version, stream, sign, enc), nil
+		}
+	}
+}
+
+// deterministicKey is the first 32 bytes of SHA-512(passphrase + varint(nonce))
+func deterministicKey(passphrase []byte, nonce uint64) *btcec.PrivateKey {
+	b := make([]byte, len(passphrase)+9)
+	copy(b, passphrase)
+	n := encodeBitmessageUvarint(b[len(passphrase):], nonce)
+	h := sha512.Sum512(b[:len(passphrase)+n])
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), h[:32])
+	return priv
+}
+
+// NewDeterministicIdentities will generate count identities from a passphrase the same way
+// PyBitmessage does, so the same passphrase always recreates the same addresses. Signing keys
+// use even nonces and encryption keys odd nonces, continuing across identities until each
+// ripe starts with zeroBytes zero bytes.
+func NewDeterministicIdentities(passphrase string, count int, version, stream uint64, zeroBytes int) []*Identity {
+	ids := make([]*Identity, 0, count)
+	var nonce uint64
+	for len(ids) < count {
+		sign := deterministicKey([]byte(passphrase), nonce)
+		enc := deterministicKey([]byte(passphrase), nonce+1)
+		nonce += 2
+		if hasZeroPrefix(CalcRipe(sign.PubKey(), enc.PubKey()), zeroBytes) {
+			ids = append(ids, NewIdentity(version, stream, sign, enc))
+		}
+	}
+	return ids
+}
+
+// EncodeWIF will encode a private key in wallet import format, as stored in PyBitmessage's keys.dat
+func EncodeWIF(key *btcec.PrivateKey) string {
+	b := make([]byte, 33, 37)
+	b[0] = 0x80
+	d := key.D.Bytes()
+	copy(b[33-len(d):], d)
+	sum := sha256.Sum256(b)
+	sum = sha256.Sum256(sum[:])
+	return encodeBase58(append(b, sum[:4]...))
+}
+
+// DecodeWIF will decode a private key in wallet import format
+func DecodeWIF(s string) (*btcec.PrivateKey, error) {
+	b, err := decodeBase58(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != 37 || b[0] != 0x80 {
+		return nil, ErrInvalidWIF
+	}
+	sum := sha256.Sum256(b[:33])
+	sum = sha256.Sum256(sum[:])
+	if !bytes.Equal(sum[:4], b[33:]) {
+		return nil, ErrInvalidWIF
+	}
+	priv, _ := btcec.PrivKeyFromBytes(btcec.S256(), b[1:33])
+	return priv, nil
+}
+
+// AddIdentity will add one of our identities to the node, so that it answers requests for its pubkey and receives messages sent to it.
+// Delivery of messages it was sending before a restart is resumed.
+func (n *Node) AddIdentity(id *Identity) {
+	n.idmx.Lock()
+	n.ids[id.Address] = id
+	n.idmx.Unlock()
+	n.resumeSends(id)
+}
+
+// RemoveIdentity will remove the identity with the given address from the node
+func (n *Node) RemoveIdentity(addr *BMAddress) {
+	n.idmx.Lock()
+	delete(n.ids, *addr)
+	n.idmx.Unlock()
+}
+
+// Identities will return the identities added to the node
+func (n *Node) Identities() []*Identity {
+	n.idmx.Lock()
+	defer n.idmx.Unlock()
+	ids := make([]*Identity, 0, len(n.ids))
+	for _, id := range n.ids {
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -0,0 +1,72 @@
+package bitmessage
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+const testPassphrase = "TIGER, tiger, burning bright. In the forests of the night"
+
+func TestNewDeterministicIdentities(t *testing.T) {
+	tests := []struct {
+		version uint64
+		addrs   []string
+	}{
+		{4, []string{"BM-2cWzSnwjJ7yRP3nLEWUV5LisTZyREWSzUK", "BM-2cWFgvNK54GnDaMpATdEkr1xUPrJ9xoNgJ"}},
+		{3, []string{"BM-2DBPTgeSawWYZceFD69AbDT5q4iUWtj1ZN"}},
+	}
+	for _, test := range tests {
+		ids := NewDeterministicIdentities(testPassphrase, len(test.addrs), test.version, 1, 1)
+		if len(ids) != len(test.addrs) {
+			t.Fatalf("v%d: got %d identities, expected %d", test.version, len(ids), len(test.addrs))
+		}
+		for i, id := range ids {
+			if s := id.Address.String(); s != test.addrs[i] {
+				t.Errorf("v%d identity %d: got %s, expected %s", test.version, i, s, test.addrs[i])
+			}
+		}
+	}
+}
+
+func TestDeterministicIdentityWIF(t *testing.T) {
+	id := NewDeterministicIdentities(testPassphrase, 1, 4, 1, 1)[0]
+	if s := EncodeWIF(id.SigningKey); s != "5JEetjBX7JyNyJASzUxhR28xuz6QQBYvWM8hFt1aFL5XW6M1bux" {
+		t.Errorf("got signing key %s", s)
+	}
+	if s := EncodeWIF(id.EncryptionKey); s != "5JkhSYR36DSB95Y7eoPzt3AWGKPqNsPXZxrZHZCw5Vx7bkSGCJh" {
+		t.Errorf("got encryption key %s", s)
+	}
+}
+
+func TestWIFRoundTrip(t *testing.T) {
+	// from the Bitcoin wiki, PyBitmessage uses the same format
+	const wif = "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ"
+	key, err := DecodeWIF(wif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := hex.EncodeToString(key.Serialize()); d != "0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d" {
+		t.Errorf("got key %s", d)
+	}
+	if s := EncodeWIF(key); s != wif {
+		t.Errorf("got %s, expected %s", s, wif)
+	}
+
+	id, err := NewRandomIdentity(4, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{EncodeWIF(id.SigningKey), EncodeWIF(id.EncryptionKey)} {
+		key, err := DecodeWIF(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := EncodeWIF(key); s != k {
+			t.Errorf("got %s, expected %s", s, k)
+		}
+	}
+
+	if _, err := DecodeWIF(wif[:len(wif)-1] + "Y"); err != ErrInvalidWIF {
+		t.Errorf("bad checksum: got %v, expected %v", err, ErrInvalidWIF)
+	}
+}
@@ -0,0 +1,118 @@
+package bitmessage
+
+import (
+	"sync"
+	"time"
+)
+
+// ObjectRequestTimeout is how long to wait for a requested object before asking another peer for it
+const ObjectRequestTimeout = time.Minute * 2
+
+type invEntry struct {
+	have        bool
+	expires     time.Time
+	stream      uint64
+	requestedBy uint64
+	requested   time.Time
+}
+
+// inventory is the index of objects we have, or have requested from a peer
+type inventory struct {
+	mx    sync.RWMutex
+	items map[InvVector]*invEntry
+}
+
+func newInventory() *inventory {
+	return &inventory{items: make(map[InvVector]*invEntry, MaxInventoryLength)}
+}
+
+// Add will record that the object v in stream is stored and expires at the given time
+func (i *inventory) Add(v InvVector, expires time.Time, stream uint64) {
+	i.mx.Lock()
+	i.items[v] = &invEntry{have: true, expires: expires, stream: stream}
+	i.mx.Unlock()
+}
+
+// Remove will remove v from the index
+func (i *inventory) Remove(v InvVector) {
+	i.mx.Lock()
+	delete(i.items, v)
+	i.mx.Unlock()
+}
+
+// Has will return true if the object v is stored
+func (i *inventory) Has(v InvVector) bool {
+	i.mx.RLock()
+	e := i.items[v]
+	i.mx.RUnlock()
+	return e != nil && e.have
+}
+
+// List will return the vectors of all stored objects in streams
+func (i *inventory) List(streams []uint64) []InvVector {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	v := make([]InvVector, 0, len(i.items))
+	for vect, e := range i.items {
+		if e.have && hasStream(streams, e.stream) {
+			v = append(v, vect)
+		}
+	}
+	return v
+}
+
+// Expired will return the vectors of all stored objects that expire before t
+func (i *inventory) Expired(t time.Time) []InvVector {
+	i.mx.RLock()
+	defer i.mx.RUnlock()
+	var v []InvVector
+	for vect, e := range i.items {
+		if e.have && e.expires.Before(t) {
+			v = append(v, vect)
+		}
+	}
+	return v
+}
+
+// Request will return the vectors in v that should be requested from peer, marking them as requested.
+// Objects we have, or that are already requested from another peer within ObjectRequestTimeout, are skipped.
+func (i *inventory) Request(peer uint64, v []InvVector, t time.Time) []InvVector {
+	i.mx.Lock()
+	defer i.mx.Unlock()
+	missing := make([]InvVector, 0, len(v))
+	for _, vect := range v {
+		e := i.items[vect]
+		if e == nil {
+			e = new(invEntry)
+			i.items[vect] = e
+		} else if e.have || t.Sub(e.requested) < ObjectRequestTimeout {
+			continue
+		}
+		e.requestedBy = peer
+		e.requested = t
+		missing = append(missing, vect)
+	}
+	return missing
+}
+
+// Release will forget all outstanding requests made to peer, so they can be requested elsewhere
+func (i *inventory) Release(peer uint64) {
+	i.mx.Lock()
+	for vect, e := range i.items {
+		if !e.have && e.requestedBy == peer {
+			delete(i.items, vect)
+		}
+	}
+	i.mx.Unlock()
+}
+
+// Prune will forget outstanding requests that timed out before t
+func (i *inventory) Prune(t time.Time) {
+	i.mx.Lock()
+	for vect, e := range i.items {
+		if !e.have && t.Sub(e.requested) >= ObjectRequestTimeout {
+			delete(i.items, vect)
+		}
+	}
+	i.mx.Unlock()
+}
@@ -0,0 +1,171 @@
+package bitmessage
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// KnownNodeMaxAge is how long an address is kept after it was last seen
+	KnownNodeMaxAge = time.Hour * 24 * 3
+	// MaxAddrClockSkew is how far in the future an advertised address time may be
+	MaxAddrClockSkew = time.Minute * 10
+	MaxAddrLength    = 1000
+)
+
+// KnownNode is a peer address learned from addr messages or connections
+type KnownNode struct {
+	FullAddress
+	Successes uint32
+	Failures  uint32
+}
+
+func (k *KnownNode) key() []byte {
+	b := make([]byte, 22)
+	order.PutUint32(b, k.Stream)
+	copy(b[4:], k.IP.To16())
+	order.PutUint16(b[20:], k.Port)
+	return b
+}
+
+func (k *KnownNode) MarshalBinary() ([]byte, error) {
+	b, err := k.FullAddress.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	s := make([]byte, 8)
+	order.PutUint32(s, k.Successes)
+	order.PutUint32(s[4:], k.Failures)
+	return append(b, s...), nil
+}
+func (k *KnownNode) UnmarshalBinary(b []byte) error {
+	err := k.FullAddress.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	k.Successes = order.Uint32(b[38:])
+	k.Failures = order.Uint32(b[42:])
+	return nil
+}
+
+// learnAddress will record an address advertised by a peer
+func (n *Node) learnAddress(a FullAddress) error {
+	if !hasStream(n.addrStreams, uint64(a.Stream)) || a.Port == 0 || a.IP.IsUnspecified() || a.IP.IsMulticast() {
+		return nil
+	}
+	now := time.Now()
+	if a.Time.After(now.Add(MaxAddrClockSkew)) {
+		a.Time = now
+	}
+	if now.Sub(a.Time) > KnownNodeMaxAge {
+		return nil
+	}
+	return n.updateKnownNode(a, func(k *KnownNode) {
+		if a.Time.After(k.Time) {
+			k.Time = a.Time
+			k.Services = a.Services
+		}
+	})
+}
+
+// updateKnownNode will apply fn to the known node for a, creating it if needed
+func (n *Node) updateKnownNode(a FullAddress, fn func(*KnownNode)) error {
+	n.knownmx.Lock()
+	defer n.knownmx.Unlock()
+	k, err := n.known.GetKnownNode(a.Stream, a.Address)
+	if err != nil {
+		return err
+	}
+	if k == nil {
+		k = &KnownNode{FullAddress: FullAddress{Stream: a.Stream, Address: a.Address}}
+	}
+	fn(k)
+	return n.known.SaveKnownNode(k)
+}
+
+// remoteAddress will return the listening address of the peer
+func (c *connection) remoteAddress() (Address, error) {
+	host, port, err := net.SplitHostPort(c.c.RemoteAddr().String())
+	if err != nil {
+		return Address{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Address{}, err
+	}
+	a := Address{
+		Services: c.version.Services,
+		IP:       net.ParseIP(host),
+		Port:     uint16(p),
+	}
+	if !c.outgoing {
+		// inbound connections come from an ephemeral port
+		a.Port = c.version.AddressFrom.Port
+	}
+	return a, nil
+}
+
+// recordHandshake will mark the peer as a working node in every stream we share with it
+func (c *connection) recordHandshake() error {
+	a, err := c.remoteAddress()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, s := range c.streams {
+		err = c.node.updateKnownNode(FullAddress{Stream: uint32(s), Address: a}, func(k *KnownNode) {
+			k.Time = now
+			k.Services = a.Services
+			k.Successes++
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// freshAddresses will return up to MaxAddrLength known nodes in streams seen within Config.NodeTimeout
+func (n *Node) freshAddresses(streams []uint64) ([]FullAddress, error) {
+	cutoff := time.Now().Add(-n.cfg.NodeTimeout)
+	var addrs []FullAddress
+	for _, s := range streams {
+		nodes, err := n.known.ListKnownNodes(uint32(s))
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range nodes {
+			if len(addrs) == MaxAddrLength {
+				return addrs, nil
+			}
+			if k.Time.After(cutoff) {
+				addrs = append(addrs, k.FullAddress)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// gcKnownNodes will remove known nodes not seen within KnownNodeMaxAge
+func (n *Node) gcKnownNodes() error {
+	n.knownmx.Lock()
+	defer n.knownmx.Unlock()
+	cutoff := time.Now().Add(-KnownNodeMaxAge)
+	for _, s := range n.addrStreams {
+		nodes, err := n.known.ListKnownNodes(uint32(s))
+		if err != nil {
+			return err
+		}
+		for i := range nodes {
+			if nodes[i].Time.After(cutoff) {
+				continue
+			}
+			err = n.known.DeleteKnownNode(&nodes[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package bitmessage
+
+import (
+	"strings"
+	"sync"
+)
+
+// memKnownNodeStore keeps known nodes in memory, for a Store that is not a KnownNodeStore
+type memKnownNodeStore struct {
+	mx    sync.Mutex
+	nodes map[string]KnownNode
+}
+
+func newMemKnownNodeStore() *memKnownNodeStore {
+	return &memKnownNodeStore{nodes: make(map[string]KnownNode)}
+}
+
+func (m *memKnownNodeStore) SaveKnownNode(k *KnownNode) error {
+	m.mx.Lock()
+	m.nodes[string(k.key())] = *k
+	m.mx.Unlock()
+	return nil
+}
+func (m *memKnownNodeStore) GetKnownNode(stream uint32, a Address) (*KnownNode, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	k, ok := m.nodes[string((&KnownNode{FullAddress: FullAddress{Stream: stream, Address: a}}).key())]
+	if !ok {
+		return nil, nil
+	}
+	return &k, nil
+}
+func (m *memKnownNodeStore) DeleteKnownNode(k *KnownNode) error {
+	m.mx.Lock()
+	delete(m.nodes, string(k.key()))
+	m.mx.Unlock()
+	return nil
+}
+func (m *memKnownNodeStore) ListKnownNodes(stream uint32) ([]KnownNode, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var result []KnownNode
+	for _, k := range m.nodes {
+		if k.Stream == stream {
+			result = append(result, k)
+		}
+	}
+	return result, nil
+}
+
+// memPubKeyStore keeps pubkeys in memory, for a Store that is not a PubKeyStore
+type memPubKeyStore struct {
+	mx      sync.Mutex
+	pubkeys map[string][]byte
+}
+
+func newMemPubKeyStore() *memPubKeyStore {
+	return &memPubKeyStore{pubkeys: make(map[string][]byte)}
+}
+
+func (m *memPubKeyStore) SavePubKey(key, data []byte) error {
+	m.mx.Lock()
+	m.pubkeys[string(key)] = append([]byte{}, data...)
+	m.mx.Unlock()
+	return nil
+}
+func (m *memPubKeyStore) GetPubKey(key []byte) ([]byte, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	data, ok := m.pubkeys[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, data...), nil
+}
+func (m *memPubKeyStore) DeletePubKey(key []byte) error {
+	m.mx.Lock()
+	delete(m.pubkeys, string(key))
+	m.mx.Unlock()
+	return nil
+}
+func (m *memPubKeyStore) ListPubKeys(prefix []byte) ([][]byte, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var result [][]byte
+	for k := range m.pubkeys {
+		if strings.HasPrefix(k, string(prefix)) {
+			result = append(result, []byte(k))
+		}
+	}
+	return result, nil
+}
+
+// memSendStore keeps messages being sent in memory, for a Store that is not a SendStore
+type memSendStore struct {
+	mx    sync.Mutex
+	sends map[string][]byte
+}
+
+func newMemSendStore() *memSendStore {
+	return &memSendStore{sends: make(map[string][]byte)}
+}
+
+func (m *memSendStore) SaveSend(ackData, data []byte) error {
+	m.mx.Lock()
+	m.sends[string(ackData)] = append([]byte{}, data...)
+	m.mx.Unlock()
+	return nil
+}
+func (m *memSendStore) DeleteSend(ackData []byte) error {
+	m.mx.Lock()
+	delete(m.sends, string(ackData))
+	m.mx.Unlock()
+	return nil
+}
+func (m *memSendStore) ListSends() ([][]byte, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	result := make([][]byte, 0, len(m.sends))
+	for _, data := range m.sends {
+		result = append(result, append([]byte{}, data...))
+	}
+	return result, nil
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha512"
 	"encoding"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -22,12 +23,38 @@ const (
 	MessageTypeInv                 = "inv"
 	MessageTypeGetData             = "getdata"
 	MessageTypeObject              = "object"
+	MessageTypePing                = "ping"
+	MessageTypePong                = "pong"
+	MessageTypeError               = "error"
 )
 
 const (
 	VersionServicesNodeNetwork = 1
 )
 
+var ErrMalformedMessage = errors.New("malformed message")
+
+// ChecksumError is returned by ReadMessage when the payload checksum does not match, the message is fully consumed
+type ChecksumError struct {
+	Command  MessageType
+	Expected []byte
+	Got      []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("invalid checksum for '%s', expected %s but got %s", e.Command, hex.EncodeToString(e.Expected), hex.EncodeToString(e.Got))
+}
+
+// LengthError is returned by ReadMessage when the header length is over MaxMessageLength, the payload is not consumed
+type LengthError struct {
+	Command MessageType
+	Length  uint32
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("Bad message length for '%s' %d > max %d", e.Command, e.Length, MaxMessageLength)
+}
+
 type MessageType string
 type Message interface {
 	Command() MessageType
@@ -73,6 +100,16 @@ type ObjectMessage struct {
 }
 
 type VerAckMessage struct{}
+type PingMessage struct{}
+type PongMessage struct{}
+
+// ErrorMessage is sent by a peer to report a problem, Fatal is 0 for a warning, 1 for an error and 2 if it will disconnect
+type ErrorMessage struct {
+	Fatal   uint64
+	BanTime uint64
+	Vector  []byte
+	Text    string
+}
 type InvVector [32]byte
 type RawMessage struct {
 	Type    MessageType
@@ -123,7 +160,7 @@ func (r *MessageReader) ReadMessage() (Message, error) {
 	}
 	l := order.Uint32(b[16:])
 	if l > MaxMessageLength {
-		return nil, fmt.Errorf("Bad message length %d > max %d", l, MaxMessageLength)
+		return nil, &LengthError{Command: cmd, Length: l}
 	}
 	data := make([]byte, l)
 	_, err = io.ReadFull(r, data)
@@ -133,7 +170,7 @@ func (r *MessageReader) ReadMessage() (Message, error) {
 
 	sum := sha512.Sum512(data)
 	if !bytes.Equal(sum[:4], b[20:24]) {
-		return nil, fmt.Errorf("invalid checksum, expected %s but got %s", hex.EncodeToString(b[20:24]), hex.EncodeToString(sum[:4]))
+		return nil, &ChecksumError{Command: cmd, Expected: b[20:24], Got: sum[:4]}
 	}
 
 	var m Message
@@ -146,12 +183,30 @@ func (r *MessageReader) ReadMessage() (Message, error) {
 		m = new(AddrMessage)
 	case MessageTypeInv:
 		m = new(InvMessage)
+	case MessageTypeGetData:
+		m = new(GetDataMessage)
 	case MessageTypeObject:
 		m = new(ObjectMessage)
+	case MessageTypePing:
+		m = new(PingMessage)
+	case MessageTypePong:
+		m = new(PongMessage)
+	case MessageTypeError:
+		m = new(ErrorMessage)
 	default:
 		m = &RawMessage{Type: cmd}
 	}
-	return m, m.UnmarshalBinary(data)
+	return m, unmarshalMessage(m, data)
+}
+
+// unmarshalMessage will decode data into m, returning ErrMalformedMessage if it is truncated
+func unmarshalMessage(m Message, data []byte) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = ErrMalformedMessage
+		}
+	}()
+	return m.UnmarshalBinary(data)
 }
 
 func (s *VersionServices) value() uint64 {
@@ -165,7 +220,8 @@ func (s *VersionServices) fromValue(value uint64) {
 	s.NodeNetwork = value&VersionServicesNodeNetwork != 0
 }
 
-func NewVersionMessage(nonce uint64, port uint16) *VersionMessage {
+// NewVersionMessage will create a VersionMessage for our node, streams defaults to stream 1
+func NewVersionMessage(nonce uint64, port uint16, streams ...uint64) *VersionMessage {
 	var v VersionMessage
 	v.Version = Version
 	v.Services.NodeNetwork = true
@@ -174,7 +230,10 @@ func NewVersionMessage(nonce uint64, port uint16) *VersionMessage {
 	v.AddressFrom.Port = port
 	v.UserAgent = UserAgent
 	v.Nonce = nonce
-	v.StreamNumbers = []uint64{1}
+	if len(streams) == 0 {
+		streams = []uint64{1}
+	}
+	v.StreamNumbers = streams
 	return &v
 }
 
@@ -251,6 +310,44 @@ func (m *VerAckMessage) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
+func (m *PingMessage) Command() MessageType {
+	return MessageTypePing
+}
+func (m *PingMessage) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+func (m *PingMessage) UnmarshalBinary(b []byte) error {
+	return nil
+}
+
+func (m *PongMessage) Command() MessageType {
+	return MessageTypePong
+}
+func (m *PongMessage) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+func (m *PongMessage) UnmarshalBinary(b []byte) error {
+	return nil
+}
+
+func (m *ErrorMessage) Command() MessageType {
+	return MessageTypeError
+}
+func (m *ErrorMessage) MarshalBinary() ([]byte, error) {
+	b := appendVarint(nil, m.Fatal)
+	b = appendVarint(b, m.BanTime)
+	b = appendVarBytes(b, m.Vector)
+	return appendVarBytes(b, []byte(m.Text)), nil
+}
+func (m *ErrorMessage) UnmarshalBinary(b []byte) error {
+	r := &plainReader{b: b}
+	m.Fatal = r.varint()
+	m.BanTime = r.varint()
+	m.Vector = r.varBytes()
+	m.Text = string(r.varBytes())
+	return r.err
+}
+
 func (m *RawMessage) Command() MessageType {
 	return m.Type
 }
@@ -278,7 +375,7 @@ func (m *AddrMessage) MarshalBinary() ([]byte, error) {
 	b = b[:blen]
 	var data []byte
 	var err error
-	for i := range m.Addresses {
+	for i := range m.Addresses[:n] {
 		data, err = m.Addresses[i].MarshalBinary()
 		if err != nil {
 			return nil, err
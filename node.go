@@ -1,25 +1,55 @@
 package bitmessage
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type Node struct {
+	cfg         Config
 	port        uint16
 	nonce       uint64
 	l           net.Listener
 	pool        map[uint64]*connection
 	poolmx      *sync.RWMutex
 	s           Store
-	objectIndex map[InvVector]bool
+	known       KnownNodeStore
+	objectIndex *inventory
+	streams     []uint64
+	addrStreams []uint64
+	knownmx     sync.Mutex
+	cm          *connManager
+	bans        *banList
+	pubkeys     *pubKeyCache
+	objects     chan *ObjectMessage
+
+	// acks holds every message being sent by its ack data, resume holds saved messages by sender until AddIdentity
+	sendmx sync.Mutex
+	sends  SendStore
+	acks   map[string]*SentMessage
+	resume map[BMAddress][]*SentMessage
+	submx  sync.Mutex
+	subs   map[BMAddress]bool
+
+	idmx       sync.Mutex
+	ids        map[BMAddress]*Identity
+	pubKeySent map[BMAddress]time.Time
+
+	quit      chan struct{}
+	closeOnce sync.Once
+	runmx     sync.Mutex
+	closed    bool
+	wg        sync.WaitGroup
 }
 type connection struct {
 	outgoing bool
@@ -30,15 +60,30 @@ type connection struct {
 	node     *Node
 	nonce    uint64
 	version  *VersionMessage
+	streams  []uint64
 	inbound  chan Message
 	outbound chan Message
+	getdata  chan InvVector
+	done     chan struct{}
+
+	scoremx sync.Mutex
+	score   int
+	scored  time.Time
+
+	invmx      sync.Mutex
+	known      map[InvVector]bool
+	pendingInv []InvVector
 }
 
+var ErrNodeClosed = errors.New("node is closed")
+
+// GCStoreLoop will garbage-collect s every minute, forever. A running Node already collects its own Store,
+// this is for a Store that is not used by a Node.
 func GCStoreLoop(s Store) {
 	t := time.NewTicker(time.Minute)
 	var err error
 	for {
-		err = gcStore(s)
+		err = gcObjects(s)
 		if err != nil {
 			log.Errorln("GC of database failed:", err)
 		}
@@ -46,29 +91,84 @@ func GCStoreLoop(s Store) {
 	}
 }
 
-// gcStore will garbage-collect Store (removing expired objects)
-func gcStore(s Store) error {
+// gcObjects will remove objects from s that ValidateObject would no longer accept
+func gcObjects(s Store) error {
 	objs, err := s.ListObjects()
 	if err != nil {
 		return err
 	}
+	t := time.Now().Add(-ObjectExpiredGrace)
 	var data []byte
 	for _, obj := range objs {
 		data, err = s.GetObject(obj)
 		if err != nil {
 			return err
 		}
-		if time.Now().Unix() >= int64(order.Uint64(data[8:])) {
-			log.Infoln("GC:", hex.EncodeToString(obj[:]))
-			err = s.DeleteObject(obj)
-			if err != nil {
-				return err
-			}
+		if data == nil || !objectExpires(data).Before(t) {
+			continue
+		}
+		log.Infoln("GC:", hex.EncodeToString(obj[:]))
+		err = s.DeleteObject(obj)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *Node) gcLoop() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	var err error
+	for {
+		err = n.gcStore()
+		if err != nil {
+			log.Errorln("GC of database failed:", err)
+		}
+		select {
+		case <-n.quit:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// gcStore will garbage-collect Store, removing objects once ValidateObject would no longer accept them,
+// so they are not requested again from peers that still advertise them
+func (n *Node) gcStore() error {
+	err := n.gcKnownNodes()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	n.objectIndex.Prune(now)
+	err = n.pubkeys.Prune(now)
+	if err != nil {
+		return err
+	}
+	for _, obj := range n.objectIndex.Expired(now.Add(-ObjectExpiredGrace)) {
+		log.Infoln("GC:", hex.EncodeToString(obj[:]))
+		err := n.s.DeleteObject(obj)
+		if err != nil {
+			return err
 		}
+		n.objectIndex.Remove(obj)
 	}
 	return nil
 }
 
+// objectExpires will return the expiration time of an encoded object
+func objectExpires(data []byte) time.Time {
+	return time.Unix(int64(order.Uint64(data[8:])), 0)
+}
+
+// objectStream will return the stream number of an encoded object
+func objectStream(data []byte) uint64 {
+	_, n := decodeBitmessageUvarint(data[20:])
+	s, _ := decodeBitmessageUvarint(data[20+n:])
+	return s
+}
+
 func nonce() uint64 {
 	buf := make([]byte, 8)
 	_, err := io.ReadFull(rand.Reader, buf)
@@ -78,38 +178,102 @@ func nonce() uint64 {
 	return order.Uint64(buf)
 }
 
+// NewNode will create a Node listening on lAddr with the default configuration
 func NewNode(lAddr string, s Store) (*Node, error) {
-	if lAddr == "" {
-		lAddr = ":8444"
+	return NewNodeConfig(Config{ListenAddr: lAddr}, s)
+}
+
+// NewNodeConfig will create a Node using cfg, unset fields use the package defaults
+func NewNodeConfig(cfg Config, s Store) (*Node, error) {
+	cfg = cfg.withDefaults()
+	l := cfg.Listener
+	if l == nil {
+		var err error
+		l, err = net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			return nil, err
+		}
 	}
-	l, err := net.Listen("tcp", lAddr)
+
+	_, port, err := net.SplitHostPort(l.Addr().String())
 	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		l.Close()
 		return nil, err
 	}
-
-	addr := l.Addr().(*net.TCPAddr)
 
 	n := &Node{
-		port:        uint16(addr.Port),
+		cfg:         cfg,
+		port:        uint16(p),
 		nonce:       nonce(),
 		l:           l,
-		pool:        make(map[uint64]*connection, 20),
+		pool:        make(map[uint64]*connection, cfg.MaxConnections),
 		poolmx:      new(sync.RWMutex),
 		s:           s,
-		objectIndex: make(map[InvVector]bool, 50000),
+		objectIndex: newInventory(),
+		streams:     cfg.Streams,
+		addrStreams: withChildStreams(cfg.Streams),
+		quit:        make(chan struct{}),
+		bans:        newBanList(),
+		objects:     make(chan *ObjectMessage, objectQueueLength),
+		acks:        make(map[string]*SentMessage),
+		resume:      make(map[BMAddress][]*SentMessage),
+		subs:        make(map[BMAddress]bool),
+		ids:         make(map[BMAddress]*Identity),
+		pubKeySent:  make(map[BMAddress]time.Time),
+	}
+	n.known, _ = s.(KnownNodeStore)
+	if n.known == nil {
+		n.known = newMemKnownNodeStore()
+	}
+	pks, _ := s.(PubKeyStore)
+	if pks == nil {
+		pks = newMemPubKeyStore()
+	}
+	n.pubkeys = newPubKeyCache(pks)
+	n.sends, _ = s.(SendStore)
+	if n.sends == nil {
+		n.sends = newMemSendStore()
+	}
+	err = n.loadSends()
+	if err != nil {
+		l.Close()
+		return nil, err
 	}
+	n.cm = newConnManager(n, cfg.OutboundConnections, cfg.BootstrapNodes)
 
 	v, err := s.ListObjects()
 	if err != nil {
+		l.Close()
 		return nil, err
 	}
+	var data []byte
 	for i := range v {
-		n.objectIndex[v[i]] = true
+		data, err = s.GetObject(v[i])
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		n.objectIndex.Add(v[i], objectExpires(data), objectStream(data))
+		if ObjectType(order.Uint32(data[16:])) == ObjectTypePubKey {
+			m := new(ObjectMessage)
+			if m.UnmarshalBinary(data) == nil && n.pubkeys.Add(m) != nil {
+				log.Debugln("ignoring stored pubkey:", hex.EncodeToString(v[i][:]))
+			}
+		}
 	}
 
 	return n, nil
 }
 
+func (n *Node) servesStream(stream uint64) bool {
+	return hasStream(n.streams, stream)
+}
+
 func (n *Node) addConnection(c *connection) {
 	n.poolmx.Lock()
 	n.pool[c.nonce] = c
@@ -117,31 +281,128 @@ func (n *Node) addConnection(c *connection) {
 }
 func (n *Node) remConnection(c *connection) {
 	n.poolmx.Lock()
-	delete(n.pool, c.nonce)
+	if n.pool[c.nonce] == c {
+		delete(n.pool, c.nonce)
+	}
 	n.poolmx.Unlock()
 }
 
+// saveObject will store an object and add it to the index
+func (n *Node) saveObject(v InvVector, data []byte) error {
+	err := n.s.SaveObject(v, data)
+	if err != nil {
+		return err
+	}
+	n.objectIndex.Add(v, objectExpires(data), objectStream(data))
+	return nil
+}
+
+// spawn will run f in a goroutine that Close waits for, returning false if the node is closed
+func (n *Node) spawn(f func()) bool {
+	n.runmx.Lock()
+	defer n.runmx.Unlock()
+	if n.closed {
+		return false
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Connect will dial a peer and handshake with it in the background, the dial is cancelled if the node is closed
 func (n *Node) Connect(address string) error {
-	conn, err := net.Dial("tcp", address)
+	ctx, cancel := n.context()
+	defer cancel()
+	conn, err := n.cfg.Dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return err
 	}
-	go n.handle(true, conn)
+	if !n.spawn(func() { n.handle(conn, address) }) {
+		conn.Close()
+		return ErrNodeClosed
+	}
 	return nil
 }
 
+// Serve will run the node until it is closed, it is the same as Run with a background context
 func (n *Node) Serve() error {
-	var conn net.Conn
+	return n.Run(context.Background())
+}
+
+// Run will accept connections and run background tasks until ctx is done or Close is called.
+// It returns once the node has completely shut down.
+func (n *Node) Run(ctx context.Context) error {
+	if !n.spawn(n.gcLoop) {
+		return ErrNodeClosed
+	}
+	n.spawn(n.cm.run)
+	n.spawn(n.processLoop)
+	errc := make(chan error, 1)
+	n.spawn(func() { errc <- n.acceptLoop() })
+
 	var err error
+	select {
+	case <-ctx.Done():
+	case <-n.quit:
+	case err = <-errc:
+	}
+	cerr := n.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (n *Node) acceptLoop() error {
 	for {
-		conn, err = n.l.Accept()
+		conn, err := n.l.Accept()
 		if err != nil {
+			select {
+			case <-n.quit:
+				return nil
+			default:
+			}
 			return err
 		}
-		go n.handle(false, conn)
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && n.bans.Banned(net.ParseIP(host)) {
+			log.Infoln("refusing connection from banned address", host)
+			conn.Close()
+			continue
+		}
+		n.poolmx.RLock()
+		full := len(n.pool) >= n.cfg.MaxConnections
+		n.poolmx.RUnlock()
+		if full {
+			log.Warnln("refusing connection from", conn.RemoteAddr().String(), "max connections reached")
+			conn.Close()
+			continue
+		}
+		if !n.spawn(func() { n.handle(conn, "") }) {
+			conn.Close()
+		}
 	}
 }
 
+// Close will stop accepting connections, disconnect all peers, stop background tasks
+// and flush the Store if it is a Syncer. It returns once every goroutine started by the node has exited.
+func (n *Node) Close() error {
+	n.closeOnce.Do(func() {
+		n.runmx.Lock()
+		n.closed = true
+		n.runmx.Unlock()
+		close(n.quit)
+		n.l.Close()
+	})
+	n.wg.Wait()
+	if s, ok := n.s.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
 func newConnection(n *Node, c net.Conn) *connection {
 	return &connection{
 		log:      log.WithField("RemoteAddr", c.RemoteAddr().String()),
@@ -149,29 +410,57 @@ func newConnection(n *Node, c net.Conn) *connection {
 		r:        MessageReader{c},
 		w:        MessageWriter{c},
 		node:     n,
-		inbound:  make(chan Message, 5),
-		outbound: make(chan Message, 5),
+		inbound:  make(chan Message, n.cfg.InboundBuffer),
+		outbound: make(chan Message, n.cfg.OutboundBuffer),
+		getdata:  make(chan InvVector, MaxInventoryLength),
+		done:     make(chan struct{}),
+		known:    make(map[InvVector]bool),
 	}
 }
 func (c *connection) readloop() {
+	defer close(c.inbound)
+	var err error
 	for {
-		c.c.SetReadDeadline(time.Now().Add(ConnectionTimeout))
-		m, err := c.r.ReadMessage()
+		c.c.SetReadDeadline(time.Now().Add(c.node.cfg.ConnectionTimeout))
+		m, rerr := c.r.ReadMessage()
+		switch e := rerr.(type) {
+		case nil:
+		case *ChecksumError:
+			err = c.misbehave(ViolationBadChecksum, e)
+		case *LengthError:
+			c.misbehave(ViolationOversizedMessage, e)
+			err = e
+		default:
+			if m == nil {
+				err = rerr
+				break
+			}
+			// the message was read but could not be decoded
+			err = c.misbehave(ViolationMalformedMessage, e)
+		}
 		if err != nil {
-			close(c.inbound)
 			c.log.Warnln("error reading message:", err)
 			return
 		}
+		if rerr != nil {
+			continue
+		}
 		if _, ok := m.(*RawMessage); ok {
-			c.log.Warnln("ignoring unknown type:", m.Command())
+			c.log.Infof("ignoring unknown command '%s'", m.Command())
 			continue
 		}
-		c.inbound <- m
+		select {
+		case <-c.done:
+			return
+		case c.inbound <- m:
+		}
 	}
 }
 
 func (c *connection) handshake(outgoing bool) error {
-	myVers := NewVersionMessage(c.node.nonce, c.node.port)
+	myVers := NewVersionMessage(c.node.nonce, c.node.port, c.node.streams...)
+	myVers.Version = c.node.cfg.ProtocolVersion
+	myVers.UserAgent = c.node.cfg.UserAgent
 	sendVersion := func() error {
 		_, err := c.w.WriteMessage(myVers)
 		if err != nil {
@@ -179,10 +468,10 @@ func (c *connection) handshake(outgoing bool) error {
 		}
 		m, err := c.r.ReadMessage()
 		if err != nil {
-			return fmt.Errorf("failed to read verack in handshake:", err.Error())
+			return fmt.Errorf("failed to read verack in handshake: %s", err.Error())
 		}
 		if m.Command() != MessageTypeVerAck {
-			return fmt.Errorf("expected verack but got:", m.Command())
+			return fmt.Errorf("expected verack but got: %s", m.Command())
 		}
 		return nil
 	}
@@ -195,7 +484,7 @@ func (c *connection) handshake(outgoing bool) error {
 	}
 	m, err := c.r.ReadMessage()
 	if err != nil {
-		return fmt.Errorf("failed to read remote version:", err.Error())
+		return fmt.Errorf("failed to read remote version: %s", err.Error())
 	}
 	if m.Command() != MessageTypeVersion {
 		return fmt.Errorf("unexpected message type during handshake (expected 'version'): %s", m.Command())
@@ -206,11 +495,12 @@ func (c *connection) handshake(outgoing bool) error {
 	}
 	c.nonce = v.Nonce
 	c.log = c.log.WithField("UserAgent", v.UserAgent)
-	if v.Version < Version {
+	if v.Version < c.node.cfg.ProtocolVersion {
 		return fmt.Errorf("version was %d, less than ours so terminating connection", v.Version)
 	}
-	if len(v.StreamNumbers) != 1 || v.StreamNumbers[0] != 1 {
-		return fmt.Errorf("we are only interested in stream 1, terminating")
+	c.streams = sharedStreams(c.node.streams, v.StreamNumbers)
+	if len(c.streams) == 0 {
+		return fmt.Errorf("no streams in common (peer has %v, we serve %v), terminating", v.StreamNumbers, c.node.streams)
 	}
 	if !v.Services.NodeNetwork {
 		return fmt.Errorf("not a normal node, terminating")
@@ -233,20 +523,37 @@ func (c *connection) serveMessage(m Message) error {
 	switch v := m.(type) {
 	case *AddrMessage:
 		for _, addr := range v.Addresses {
-			c.log.Infoln("Got Address:", addr.IP.String())
-		}
-	case *InvMessage:
-		missing := make([]InvVector, 0, len(v.Inventory))
-		for _, i := range v.Inventory {
-			if !c.node.objectIndex[i] {
-				missing = append(missing, i)
+			err := c.node.learnAddress(addr)
+			if err != nil {
+				return err
 			}
 		}
+	case *PingMessage:
+		return c.send(&PongMessage{})
+	case *PongMessage:
+	case *ErrorMessage:
+		c.log.Warnf("peer reported error (fatal %d): %s", v.Fatal, v.Text)
+	case *InvMessage:
+		c.markKnown(v.Inventory...)
+		missing := c.node.objectIndex.Request(c.nonce, v.Inventory, time.Now())
 		// request in byte-order
 		sort.Sort(InvVectors(missing))
 		if len(missing) > 0 {
 			c.log.Infof("requesting %d missing objects", len(missing))
-			c.outbound <- &GetDataMessage{Inventory: missing}
+			return c.send(&GetDataMessage{Inventory: missing})
+		}
+	case *GetDataMessage:
+		if len(v.Inventory) > MaxInventoryLength {
+			return fmt.Errorf("getdata requested %d objects, max is %d", len(v.Inventory), MaxInventoryLength)
+		}
+		c.markKnown(v.Inventory...)
+		for i, vect := range v.Inventory {
+			select {
+			case c.getdata <- vect:
+			default:
+				c.log.Warnf("getdata queue full, dropping %d requested objects", len(v.Inventory)-i)
+				return nil
+			}
 		}
 	case *ObjectMessage:
 		data, err := v.MarshalBinary()
@@ -254,43 +561,178 @@ func (c *connection) serveMessage(m Message) error {
 			return err
 		}
 		vect := CalcVector(data)
+		c.markKnown(vect)
+		if c.node.objectIndex.Has(vect) {
+			return nil
+		}
+		err = c.node.validateObject(v, data)
+		if err != nil {
+			violation := ViolationInvalidObject
+			if oe, ok := err.(*ObjectError); ok {
+				switch oe.Reason {
+				case ErrInsufficientPOW:
+					violation = ViolationInvalidPOW
+				case ErrObjectExpired:
+					// the object may have expired while it was being relayed
+					c.log.Infoln(err)
+					return nil
+				}
+			}
+			return c.misbehave(violation, err)
+		}
 		c.log.Infoln("Store:", hex.EncodeToString(vect[:]))
-		return c.node.s.SaveObject(vect, data)
+		err = c.node.saveObject(vect, data)
+		if err != nil {
+			return err
+		}
+		c.node.announce(vect, v.Stream, c)
+		c.node.received(v)
 	}
 	return nil
 }
 
-func (n *Node) handle(outgoing bool, conn net.Conn) {
+// serveGetData will send objects requested by the peer, no faster than one per Config.GetDataInterval
+func (c *connection) serveGetData() {
+	t := time.NewTicker(c.node.cfg.GetDataInterval)
+	defer t.Stop()
+	for {
+		var v InvVector
+		select {
+		case <-c.done:
+			return
+		case v = <-c.getdata:
+		}
+		data, err := c.node.s.GetObject(v)
+		if err != nil {
+			c.log.Warnln("failed to load requested object:", err)
+			continue
+		}
+		if data == nil {
+			c.log.Infoln("requested object not found:", v)
+			continue
+		}
+		m := new(ObjectMessage)
+		err = m.UnmarshalBinary(data)
+		if err != nil {
+			c.log.Warnln("failed to decode stored object:", err)
+			continue
+		}
+		if !hasStream(c.streams, m.Stream) {
+			c.log.Infoln("requested object is not in a shared stream:", v)
+			continue
+		}
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		select {
+		case <-c.done:
+			return
+		case c.outbound <- m:
+		}
+	}
+}
+
+func (c *connection) send(m Message) error {
+	c.log.Infoln("send:", m.Command())
+	_, err := c.w.WriteMessage(m)
+	if err != nil {
+		return fmt.Errorf("send message failed: %s", err.Error())
+	}
+	return nil
+}
+
+// handle will run a connection, dialed is the address an outgoing connection was made to or empty for incoming ones
+func (n *Node) handle(conn net.Conn, dialed string) {
 	c := newConnection(n, conn)
+	c.outgoing = dialed != ""
 	defer func() {
 		err := recover()
 		if err != nil {
 			c.log.Errorln(err)
 		}
+		close(c.done)
+		n.remConnection(c)
+		n.objectIndex.Release(c.nonce)
 		conn.Close()
+		if c.outgoing {
+			n.cm.wakeUp()
+		}
 		c.log.Infoln("connection terminated")
 	}()
 	c.log.Infoln("new connection")
-	conn.SetReadDeadline(time.Now().Add(HandshakeTimeout))
-	err := c.handshake(outgoing)
+
+	// disconnect when the node is closed
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		select {
+		case <-n.quit:
+			conn.Close()
+		case <-c.done:
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(n.cfg.HandshakeTimeout))
+	err := c.handshake(c.outgoing)
+	if c.outgoing {
+		n.cm.dialDone(dialed, err)
+	}
 	if err != nil {
 		c.log.Warnln(err)
 		return
 	}
 
 	n.addConnection(c)
-	// TODO: send addrs
+	err = c.recordHandshake()
+	if err != nil {
+		c.log.Warnln("failed to record known node:", err)
+	}
+	addrs, err := n.freshAddresses(withChildStreams(c.streams))
+	if err != nil {
+		c.log.Warnln("failed to list known nodes:", err)
+	} else if len(addrs) > 0 {
+		err = c.send(&AddrMessage{Addresses: addrs})
+		if err != nil {
+			c.log.Warnln(err)
+			return
+		}
+	}
 
-	im := &InvMessage{}
-	im.Inventory, err = c.node.s.ListObjects()
-	c.outbound <- im
-	im = nil
+	err = c.sendInv(n.objectIndex.List(c.streams))
+	if err != nil {
+		c.log.Warnln(err)
+		return
+	}
 
-	go c.readloop()
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		c.readloop()
+	}()
+	go func() {
+		defer n.wg.Done()
+		c.serveGetData()
+	}()
+	relay := time.NewTicker(n.cfg.RelayInterval)
+	defer relay.Stop()
 	var m Message
+	var ok bool
 	for {
 		select {
-		case m = <-c.inbound:
+		case <-n.quit:
+			return
+		case <-relay.C:
+			err = c.flushInv()
+			if err != nil {
+				c.log.Warnln(err)
+				return
+			}
+		case m, ok = <-c.inbound:
+			if !ok {
+				return
+			}
 			c.log.Infoln("recv:", m.Command())
 			err = c.serveMessage(m)
 			if err != nil {
@@ -298,10 +740,9 @@ func (n *Node) handle(outgoing bool, conn net.Conn) {
 				return
 			}
 		case m = <-c.outbound:
-			c.log.Infoln("send:", m.Command())
-			_, err = c.w.WriteMessage(m)
+			err = c.send(m)
 			if err != nil {
-				c.log.Warnln("send message failed:", err)
+				c.log.Warnln(err)
 				return
 			}
 		}
@@ -2,11 +2,13 @@ package bitmessage
 
 import (
 	"crypto/sha512"
-	"math"
+	"fmt"
+	"io"
+	"sync"
 )
 
 const (
-	ObjectTypeGetPubKey uint32 = iota
+	ObjectTypeGetPubKey ObjectType = iota
 	ObjectTypePubKey
 	ObjectTypeMsg
 	ObjectTypeBroadcast
@@ -14,19 +16,152 @@ const (
 
 type ObjectType uint32
 
+func (t ObjectType) String() string {
+	switch t {
+	case ObjectTypeGetPubKey:
+		return "getpubkey"
+	case ObjectTypePubKey:
+		return "pubkey"
+	case ObjectTypeMsg:
+		return "msg"
+	case ObjectTypeBroadcast:
+		return "broadcast"
+	}
+	return fmt.Sprintf("ObjectType(%d)", uint32(t))
+}
+
+// GetPubKeyOldObject is a request for the pubkey of a v2 or v3 address
 type GetPubKeyOldObject struct {
 	Ripe [20]byte
 }
+
+// GetPubKeyObject is a request for the pubkey of a v4 address
 type GetPubKeyObject struct {
 	Tag [32]byte
 }
 
-type PubKey2Object struct {
+// MsgObject is an encrypted person-to-person message
+type MsgObject struct {
+	Encrypted []byte
+
+	header []byte
 }
-type PubKey3Object struct {
+
+// Broadcast4Object is an encrypted broadcast from a v2, v3 or v4 address
+type Broadcast4Object struct {
+	Encrypted []byte
+
+	header []byte
 }
-type MsgObject struct {
+
+// Broadcast5Object is an encrypted broadcast from a v4 address, identified by the address tag
+type Broadcast5Object struct {
+	Tag       [32]byte
 	Encrypted []byte
+
+	header []byte
+}
+
+// ObjectDecoder decodes the payload of an object into a concrete type
+type ObjectDecoder func(m *ObjectMessage) (interface{}, error)
+
+type objectDecoderKey struct {
+	t       ObjectType
+	version uint64
+}
+
+var decodersmx sync.RWMutex
+var decoders = map[objectDecoderKey]ObjectDecoder{
+	{ObjectTypeGetPubKey, 2}: decodeGetPubKeyOld,
+	{ObjectTypeGetPubKey, 3}: decodeGetPubKeyOld,
+	{ObjectTypeGetPubKey, 4}: decodeGetPubKey,
+	{ObjectTypePubKey, 2}:    decodePubKey,
+	{ObjectTypePubKey, 3}:    decodePubKey,
+	{ObjectTypePubKey, 4}:    decodePubKey,
+	{ObjectTypeMsg, 1}:       decodeMsg,
+	{ObjectTypeBroadcast, 4}: decodeBroadcast4,
+	{ObjectTypeBroadcast, 5}: decodeBroadcast5,
+}
+
+// RegisterObjectDecoder will set the decoder used by Decode for objects of type t and version, replacing any existing decoder
+func RegisterObjectDecoder(t ObjectType, version uint64, d ObjectDecoder) {
+	decodersmx.Lock()
+	defer decodersmx.Unlock()
+	if d == nil {
+		delete(decoders, objectDecoderKey{t, version})
+		return
+	}
+	decoders[objectDecoderKey{t, version}] = d
+}
+
+// Decode will decode the payload of the object using the decoder registered for its type and version.
+// ErrUnknownType is returned if there is no decoder for the type, and ErrUnknownVersion if the type is known but the version is not.
+func (m *ObjectMessage) Decode() (interface{}, error) {
+	decodersmx.RLock()
+	d, ok := decoders[objectDecoderKey{m.Type, m.Version}]
+	if !ok {
+		for k := range decoders {
+			if k.t == m.Type {
+				decodersmx.RUnlock()
+				return nil, ErrUnknownVersion
+			}
+		}
+	}
+	decodersmx.RUnlock()
+	if !ok {
+		return nil, ErrUnknownType
+	}
+	return d(m)
+}
+
+func decodeGetPubKeyOld(m *ObjectMessage) (interface{}, error) {
+	if len(m.Payload) < 20 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	o := new(GetPubKeyOldObject)
+	copy(o.Ripe[:], m.Payload)
+	return o, nil
+}
+func decodeGetPubKey(m *ObjectMessage) (interface{}, error) {
+	if len(m.Payload) < 32 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	o := new(GetPubKeyObject)
+	copy(o.Tag[:], m.Payload)
+	return o, nil
+}
+func decodePubKey(m *ObjectMessage) (interface{}, error) {
+	return m.DecodePubKey()
+}
+func decodeMsg(m *ObjectMessage) (interface{}, error) {
+	return &MsgObject{Encrypted: copyBytes(m.Payload), header: m.header()}, nil
+}
+func decodeBroadcast4(m *ObjectMessage) (interface{}, error) {
+	return &Broadcast4Object{Encrypted: copyBytes(m.Payload), header: m.header()}, nil
+}
+func decodeBroadcast5(m *ObjectMessage) (interface{}, error) {
+	if len(m.Payload) < 32 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	o := &Broadcast5Object{Encrypted: copyBytes(m.Payload[32:]), header: m.header()}
+	copy(o.Tag[:], m.Payload)
+	return o, nil
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// header will return the object header from the expiration time through the stream, which is covered by object signatures
+func (m *ObjectMessage) header() []byte {
+	b := make([]byte, 30)
+	order.PutUint64(b, uint64(m.Expires.Unix()))
+	order.PutUint32(b[8:], uint32(m.Type))
+	n := encodeBitmessageUvarint(b[12:], m.Version)
+	n += encodeBitmessageUvarint(b[12+n:], m.Stream)
+	return b[:12+n]
 }
 
 type InvVectors []InvVector
@@ -53,29 +188,6 @@ func GetPOWValue(data []byte) uint64 {
 	h := sha512.New()
 	h.Write(nonce)
 	h.Write(initialHash[:])
-	resultHash := h.Sum(nil)
-	h.Reset()
-	resultHash = h.Sum(resultHash)
-	return order.Uint64(resultHash)
-}
-
-func DoPOW(data []byte, target uint64) uint64 {
-	var trialValue uint64 = math.MaxUint64
-	payload := data[8:]
-	var nonce uint64 = 0
-	h := sha512.New()
-	initialHash := h.Sum(payload)
-	b := make([]byte, 8)
-	var resHash []byte
-	for trialValue > target {
-		nonce++
-		h.Reset()
-		order.PutUint64(b, nonce)
-		h.Write(b)
-		resHash = h.Sum(initialHash)
-		h.Reset()
-		resHash = h.Sum(resHash)
-		trialValue = order.Uint64(resHash[:])
-	}
-	return nonce
+	resultHash := sha512.Sum512(h.Sum(nil))
+	return order.Uint64(resultHash[:])
 }
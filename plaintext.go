@@ -0,0 +1,195 @@
+package bitmessage
+
+import (
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"io"
+)
+
+var ErrNoMatchingIdentity = errors.New("object is not encrypted for any of the given identities")
+var ErrDestinationMismatch = errors.New("message destination does not match the recipient")
+
+// Sender is the sender address and public keys included in the plaintext of msg and broadcast objects
+type Sender struct {
+	Address            BMAddress
+	Behavior           PubKeyBehavior
+	SigningKey         *btcec.PublicKey
+	EncryptionKey      *btcec.PublicKey
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
+}
+
+// PlainMessage is a decrypted msg object
+type PlainMessage struct {
+	From     Sender
+	To       BMAddress
+	Encoding uint64
+	MessageContent
+	// ContentErr is why Message could not be decoded into MessageContent, which is then empty
+	ContentErr error
+	Message    []byte
+	Ack        []byte
+	Signature  []byte
+}
+
+// plainReader reads fields of a plaintext, the first error encountered is kept and later reads return nothing
+type plainReader struct {
+	b   []byte
+	n   int
+	err error
+}
+
+func (r *plainReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := decodeBitmessageUvarint(r.b[r.n:])
+	if n == 0 {
+		r.err = io.ErrUnexpectedEOF
+	}
+	r.n += n
+	return v
+}
+func (r *plainReader) bytes(l uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(len(r.b)-r.n) < l {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, l)
+	copy(b, r.b[r.n:])
+	r.n += int(l)
+	return b
+}
+func (r *plainReader) varBytes() []byte {
+	return r.bytes(r.varint())
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [9]byte
+	return append(b, buf[:encodeBitmessageUvarint(buf[:], v)]...)
+}
+func appendVarBytes(b, data []byte) []byte {
+	return append(appendVarint(b, uint64(len(data))), data...)
+}
+
+func (s *Sender) read(r *plainReader) {
+	s.Address.Version = r.varint()
+	s.Address.Stream = r.varint()
+	keys := r.bytes(132)
+	if r.err != nil {
+		return
+	}
+	if s.Address.Version < 2 || s.Address.Version > 4 {
+		r.err = ErrAddressVersion
+		return
+	}
+	var pk PubKey2Object
+	r.err = pk.UnmarshalBinary(keys)
+	if r.err != nil {
+		return
+	}
+	s.Behavior, s.SigningKey, s.EncryptionKey = pk.Behavior, pk.SigningKey, pk.EncryptionKey
+	s.Address.Ripe = CalcRipe(s.SigningKey, s.EncryptionKey)
+	if s.Address.Version == 2 {
+		s.NonceTrialsPerByte, s.ExtraBytes = NetworkNonceTrialsPerByte, NetworkPayloadLengthExtraBytes
+		return
+	}
+	s.NonceTrialsPerByte = r.varint()
+	s.ExtraBytes = r.varint()
+}
+func (s *Sender) append(b []byte) []byte {
+	b = appendVarint(b, s.Address.Version)
+	b = appendVarint(b, s.Address.Stream)
+	pk := PubKey2Object{Behavior: s.Behavior, SigningKey: s.SigningKey, EncryptionKey: s.EncryptionKey}
+	keys, _ := pk.MarshalBinary()
+	b = append(b, keys...)
+	if s.Address.Version == 2 {
+		return b
+	}
+	b = appendVarint(b, s.NonceTrialsPerByte)
+	return appendVarint(b, s.ExtraBytes)
+}
+
+// POWParams will return the difficulty the sender requires of objects sent to them
+func (s *Sender) POWParams() POWParams {
+	return POWParams{NonceTrialsPerByte: s.NonceTrialsPerByte, ExtraBytes: s.ExtraBytes}
+}
+
+// signedData will return the encoded message without the signature
+func (m *PlainMessage) signedData() []byte {
+	b := m.From.append(nil)
+	b = append(b, m.To.Ripe[:]...)
+	b = appendVarint(b, m.Encoding)
+	b = appendVarBytes(b, m.Message)
+	return appendVarBytes(b, m.Ack)
+}
+func (m *PlainMessage) MarshalBinary() ([]byte, error) {
+	return appendVarBytes(m.signedData(), m.Signature), nil
+}
+
+// UnmarshalBinary will decode a plaintext message, To is only filled with the destination ripe
+func (m *PlainMessage) UnmarshalBinary(b []byte) error {
+	_, err := m.unmarshal(b)
+	return err
+}
+
+// unmarshal will decode a plaintext message, returning the length of the signed data
+func (m *PlainMessage) unmarshal(b []byte) (int, error) {
+	r := &plainReader{b: b}
+	m.From.read(r)
+	copy(m.To.Ripe[:], r.bytes(20))
+	m.Encoding = r.varint()
+	m.Message = r.varBytes()
+	m.Ack = r.varBytes()
+	signed := r.n
+	m.Signature = r.varBytes()
+	if r.err != nil {
+		return 0, r.err
+	}
+	m.MessageContent, m.ContentErr = MessageContent{}, nil
+	c, err := DecodeMessageContent(m.Encoding, m.Message)
+	if err != nil {
+		m.ContentErr = err
+	} else {
+		m.MessageContent = *c
+	}
+	return signed, nil
+}
+
+// Sign will sign the message for an object with the given header
+func (m *PlainMessage) Sign(header []byte, key *btcec.PrivateKey) error {
+	sig, err := signData(key, append(append([]byte{}, header...), m.signedData()...))
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// Decrypt will try to decrypt the message with each identity, then verify its destination and signature
+func (o *MsgObject) Decrypt(ids ...*Identity) (*PlainMessage, error) {
+	for _, id := range ids {
+		plain, err := Decrypt(id.EncryptionKey, o.Encrypted)
+		if err != nil {
+			continue
+		}
+		m := new(PlainMessage)
+		signed, err := m.unmarshal(plain)
+		if err != nil {
+			return nil, err
+		}
+		if m.To.Ripe != id.Address.Ripe {
+			return nil, ErrDestinationMismatch
+		}
+		m.To = id.Address
+		err = verifySignature(m.From.SigningKey, append(append([]byte{}, o.header...), plain[:signed]...), m.Signature)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	return nil, ErrNoMatchingIdentity
+}
@@ -0,0 +1,219 @@
+package bitmessage
+
+import (
+	"context"
+	"crypto/sha512"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	NetworkNonceTrialsPerByte      = 1000
+	NetworkPayloadLengthExtraBytes = 1000
+	// MinObjectTTL is the smallest TTL used when calculating a target
+	MinObjectTTL = time.Minute * 5
+
+	DefaultPOWProgressInterval = time.Second
+	// powBatch is the number of trials a worker does between checking for cancellation
+	powBatch = 4096
+)
+
+// POWParams are the difficulty parameters of a proof of work, as advertised in a recipient's pubkey
+type POWParams struct {
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
+}
+
+// NetworkPOWParams are the network minimum difficulty parameters
+var NetworkPOWParams = POWParams{
+	NonceTrialsPerByte: NetworkNonceTrialsPerByte,
+	ExtraBytes:         NetworkPayloadLengthExtraBytes,
+}
+
+// Normalize will raise any parameters below the network minimum, as a pubkey may not ask for less work than the network does
+func (p POWParams) Normalize() POWParams {
+	if p.NonceTrialsPerByte < NetworkNonceTrialsPerByte {
+		p.NonceTrialsPerByte = NetworkNonceTrialsPerByte
+	}
+	if p.ExtraBytes < NetworkPayloadLengthExtraBytes {
+		p.ExtraBytes = NetworkPayloadLengthExtraBytes
+	}
+	return p
+}
+
+// Target will return the POW target for an object of length bytes (including the nonce) that lives for ttl
+func (p POWParams) Target(length int, ttl time.Duration) uint64 {
+	return POWTarget(length, ttl, p.NonceTrialsPerByte, p.ExtraBytes)
+}
+
+var two64 = new(big.Int).Lsh(big.NewInt(1), 64)
+
+// POWTarget will calculate the maximum POW value for an object of length bytes (including the nonce) that lives for ttl:
+//
+//	2^64 / (nonceTrialsPerByte * (length + extraBytes + ttl*(length+extraBytes)/2^16))
+//
+// ttl is in seconds and at least MinObjectTTL.
+func POWTarget(length int, ttl time.Duration, nonceTrialsPerByte, extraBytes uint64) uint64 {
+	if ttl < MinObjectTTL {
+		ttl = MinObjectTTL
+	}
+	l := new(big.Int).SetUint64(uint64(length))
+	l.Add(l, new(big.Int).SetUint64(extraBytes))
+	d := big.NewInt(int64(ttl / time.Second))
+	d.Mul(d, l)
+	d.Rsh(d, 16)
+	d.Add(d, l)
+	d.Mul(d, new(big.Int).SetUint64(nonceTrialsPerByte))
+	if d.Sign() == 0 {
+		return math.MaxUint64
+	}
+	t := new(big.Int).Div(two64, d)
+	if !t.IsUint64() {
+		return math.MaxUint64
+	}
+	return t.Uint64()
+}
+
+// TTL will return the time remaining until the object expires
+func (m *ObjectMessage) TTL() time.Duration {
+	return m.Expires.Sub(time.Now())
+}
+
+// Target will return the POW target of the object for p, using its current TTL
+func (m *ObjectMessage) Target(p POWParams) uint64 {
+	data, _ := m.MarshalBinary()
+	return p.Target(len(data), m.TTL())
+}
+
+// MeetsTarget will return true if the POW value of the object is at or below target
+func (m *ObjectMessage) MeetsTarget(target uint64) bool {
+	data, _ := m.MarshalBinary()
+	return GetPOWValue(data) <= target
+}
+
+// DoPOW will set the nonce of the object to meet the target for p, p is normalized to the network minimum
+func (m *ObjectMessage) DoPOW(ctx context.Context, e *POWEngine, p POWParams) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	nonce, err := e.Do(ctx, data, p.Normalize().Target(len(data), m.TTL()))
+	if err != nil {
+		return err
+	}
+	m.Nonce = nonce
+	return nil
+}
+
+// POWProgress reports the state of a running proof of work
+type POWProgress struct {
+	Hashes  uint64
+	Elapsed time.Duration
+	// HashRate is in hashes per second
+	HashRate float64
+	// Remaining is the estimated time until the expected number of trials for the target is reached
+	Remaining time.Duration
+}
+
+// POWEngine will perform proof of work using multiple goroutines, the zero value uses every CPU
+type POWEngine struct {
+	// Workers is the number of goroutines to use, defaults to runtime.NumCPU()
+	Workers int
+	// Progress is called every ProgressInterval while working, if set
+	Progress         func(POWProgress)
+	ProgressInterval time.Duration
+}
+
+// expectedTrials will return the average number of trials needed to reach target
+func expectedTrials(target uint64) float64 {
+	return math.Exp2(64) / (float64(target) + 1)
+}
+
+// Do will find a nonce for data, whose first 8 bytes are the nonce, such that GetPOWValue
+// is at or below target. It returns ctx.Err() if ctx is done before a nonce is found.
+func (e *POWEngine) Do(ctx context.Context, data []byte, target uint64) (uint64, error) {
+	workers := e.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	interval := e.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultPOWProgressInterval
+	}
+	initialHash := sha512.Sum512(data[8:])
+
+	var hashes uint64
+	var stop int32
+	found := make(chan uint64, workers)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(start uint64) {
+			defer wg.Done()
+			powWorker(initialHash, target, start, uint64(workers), &stop, &hashes, found)
+		}(uint64(i))
+	}
+	defer func() {
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+	}()
+
+	start := time.Now()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case nonce := <-found:
+			return nonce, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-t.C:
+			if e.Progress == nil {
+				continue
+			}
+			p := POWProgress{
+				Hashes:  atomic.LoadUint64(&hashes),
+				Elapsed: time.Since(start),
+			}
+			p.HashRate = float64(p.Hashes) / p.Elapsed.Seconds()
+			if left := expectedTrials(target) - float64(p.Hashes); left > 0 && p.HashRate > 0 {
+				p.Remaining = time.Duration(math.MaxInt64)
+				if r := left / p.HashRate * float64(time.Second); r < float64(math.MaxInt64) {
+					p.Remaining = time.Duration(r)
+				}
+			}
+			e.Progress(p)
+		}
+	}
+}
+
+// powWorker will try nonces start, start+step, start+2*step... until one meets target or stop is set
+func powWorker(initialHash [64]byte, target, start, step uint64, stop *int32, hashes *uint64, found chan<- uint64) {
+	buf := make([]byte, 8+len(initialHash))
+	copy(buf[8:], initialHash[:])
+	nonce := start
+	for atomic.LoadInt32(stop) == 0 {
+		for i := 0; i < powBatch; i++ {
+			order.PutUint64(buf, nonce)
+			first := sha512.Sum512(buf)
+			result := sha512.Sum512(first[:])
+			if order.Uint64(result[:]) <= target {
+				atomic.AddUint64(hashes, uint64(i+1))
+				found <- nonce
+				return
+			}
+			nonce += step
+		}
+		atomic.AddUint64(hashes, powBatch)
+	}
+}
+
+// DoPOW will find a nonce for data, whose first 8 bytes are the nonce, using every CPU
+func DoPOW(data []byte, target uint64) uint64 {
+	nonce, _ := new(POWEngine).Do(context.Background(), data, target)
+	return nonce
+}
@@ -0,0 +1,59 @@
+package bitmessage
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPOWEngineDo(t *testing.T) {
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	target := uint64(math.MaxUint64) / 20000
+	for _, workers := range []int{1, 2, 3, 8} {
+		e := &POWEngine{Workers: workers}
+		nonce, err := e.Do(context.Background(), data, target)
+		if err != nil {
+			t.Fatalf("%d workers: %s", workers, err)
+		}
+		order.PutUint64(data, nonce)
+		if v := GetPOWValue(data); v > target {
+			t.Errorf("%d workers: POW value %d is above target %d", workers, v, target)
+		}
+	}
+}
+
+func TestPOWEngineCancel(t *testing.T) {
+	data := make([]byte, 100)
+	e := &POWEngine{Workers: 2}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := e.Do(ctx, data, 0)
+	if err != context.Canceled {
+		t.Errorf("got %v, expected %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = e.Do(ctx, data, 0)
+	if err != context.DeadlineExceeded {
+		t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestObjectDoPOW(t *testing.T) {
+	m := &ObjectMessage{Expires: time.Now().Add(time.Minute * 10), Type: ObjectTypeMsg, Version: 1, Stream: 1, Payload: []byte("hello world")}
+	err := m.DoPOW(context.Background(), new(POWEngine), NetworkPOWParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := m.MarshalBinary()
+	err = ValidateObject(data)
+	if err != nil {
+		t.Error(err)
+	}
+}
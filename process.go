@@ -0,0 +1,155 @@
+package bitmessage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// objectQueueLength is the number of received objects buffered for processing
+const objectQueueLength = 1000
+
+// received will queue a stored object for processing, blocking if the queue is full
+func (n *Node) received(m *ObjectMessage) {
+	select {
+	case <-n.quit:
+	case n.objects <- m:
+	}
+}
+
+// processLoop will process received objects until the node is closed
+func (n *Node) processLoop() {
+	for {
+		select {
+		case <-n.quit:
+			return
+		case m := <-n.objects:
+			n.processObject(m)
+		}
+	}
+}
+
+// processObject will act on objects that concern us
+func (n *Node) processObject(m *ObjectMessage) {
+	switch m.Type {
+	case ObjectTypeGetPubKey:
+		n.getPubKeyReceived(m)
+	case ObjectTypePubKey:
+		err := n.pubkeys.Add(m)
+		if err != nil {
+			log.Debugln("ignoring pubkey:", err)
+		}
+	case ObjectTypeMsg:
+		n.ackReceived(m.Payload)
+		n.msgReceived(m)
+	case ObjectTypeBroadcast:
+		n.broadcastReceived(m)
+	}
+}
+
+// msgReceived will deliver a msg object to Config.OnMessage if it is for one of our identities, then publish its ack
+func (n *Node) msgReceived(m *ObjectMessage) {
+	o, err := m.Decode()
+	if err != nil {
+		log.Debugln("ignoring msg:", err)
+		return
+	}
+	// a decoder registered with RegisterObjectDecoder may return another type
+	mo, ok := o.(*MsgObject)
+	if !ok {
+		return
+	}
+	pm, err := mo.Decrypt(n.Identities()...)
+	if err == ErrNoMatchingIdentity {
+		return
+	}
+	if err != nil {
+		log.Warnln("invalid msg:", err)
+		return
+	}
+	log.Infoln("message from", pm.From.Address.String(), "to", pm.To.String())
+	if n.cfg.OnMessage != nil {
+		n.cfg.OnMessage(pm)
+	}
+	n.idmx.Lock()
+	id := n.ids[pm.To]
+	n.idmx.Unlock()
+	if id == nil || id.SuppressAcks || len(pm.Ack) == 0 {
+		return
+	}
+	err = n.publishAck(pm.Ack)
+	if err != nil {
+		log.Warnln("not publishing ack for message from", pm.From.Address.String()+":", err)
+	}
+}
+
+var errAckNotObject = errors.New("ack is not an object message")
+
+// publishAck will validate and publish the ack object embedded in a message, unless we already have it
+func (n *Node) publishAck(ack []byte) error {
+	msg, err := (&MessageReader{bytes.NewReader(ack)}).ReadMessage()
+	if err != nil {
+		return err
+	}
+	obj, ok := msg.(*ObjectMessage)
+	if !ok {
+		return errAckNotObject
+	}
+	data, err := obj.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if n.objectIndex.Has(CalcVector(data)) {
+		return nil
+	}
+	err = n.validateObject(obj, data)
+	if err != nil {
+		return err
+	}
+	// we are in processLoop, so process the ack here rather than queueing it
+	_, err = n.announceObject(obj)
+	if err != nil {
+		return err
+	}
+	n.processObject(obj)
+	return nil
+}
+
+// publish will store an object we created, announce it to every peer in its stream and queue it for processing
+func (n *Node) publish(m *ObjectMessage) (InvVector, error) {
+	v, err := n.announceObject(m)
+	if err != nil {
+		return v, err
+	}
+	n.received(m)
+	return v, nil
+}
+
+// announceObject will store an object and announce it to every peer in its stream
+func (n *Node) announceObject(m *ObjectMessage) (InvVector, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return InvVector{}, err
+	}
+	v := CalcVector(data)
+	err = n.saveObject(v, data)
+	if err != nil {
+		return v, err
+	}
+	n.announce(v, m.Stream, nil)
+	return v, nil
+}
+
+// context will return a context that is cancelled when the node is closed
+func (n *Node) context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-n.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
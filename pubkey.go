@@ -0,0 +1,254 @@
+package bitmessage
+
+import (
+	"bytes"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+	"io"
+)
+
+const (
+	PubKeyBehaviorDoesAck            = 1
+	PubKeyBehaviorIncludeDestination = 2
+)
+
+var ErrUnknownVersion = errors.New("unknown object version")
+var ErrTagMismatch = errors.New("object tag does not match address")
+var ErrAddressMismatch = errors.New("pubkey does not match address")
+
+// PubKeyBehavior is the behavior bitfield of a pubkey
+type PubKeyBehavior struct {
+	// DoesAck is set if the owner sends acknowledgements for received messages
+	DoesAck bool
+	// IncludeDestination is set if the owner wants the destination ripe included in messages
+	IncludeDestination bool
+}
+
+func (b *PubKeyBehavior) value() uint32 {
+	var v uint32
+	if b.DoesAck {
+		v |= PubKeyBehaviorDoesAck
+	}
+	if b.IncludeDestination {
+		v |= PubKeyBehaviorIncludeDestination
+	}
+	return v
+}
+func (b *PubKeyBehavior) fromValue(v uint32) {
+	b.DoesAck = v&PubKeyBehaviorDoesAck != 0
+	b.IncludeDestination = v&PubKeyBehaviorIncludeDestination != 0
+}
+
+// PubKey is implemented by every pubkey object version
+type PubKey interface {
+	Keys() (signing, encryption *btcec.PublicKey)
+	POWParams() POWParams
+}
+
+// pubKeyBehavior will return the behavior advertised by a pubkey
+func pubKeyBehavior(p PubKey) PubKeyBehavior {
+	switch k := p.(type) {
+	case *PubKey2Object:
+		return k.Behavior
+	case *PubKey3Object:
+		return k.Behavior
+	case *PubKey4Object:
+		return k.Behavior
+	}
+	return PubKeyBehavior{}
+}
+
+// PubKey2Object is a version 2 pubkey, it is not signed and uses the network difficulty
+type PubKey2Object struct {
+	Behavior      PubKeyBehavior
+	SigningKey    *btcec.PublicKey
+	EncryptionKey *btcec.PublicKey
+}
+
+// PubKey3Object is a signed version 3 pubkey with custom difficulty
+type PubKey3Object struct {
+	PubKey2Object
+	NonceTrialsPerByte uint64
+	ExtraBytes         uint64
+	Signature          []byte
+}
+
+// PubKey4Object is a version 4 pubkey, its PubKey3Object is encrypted with the address-derived key and filled by Decrypt
+type PubKey4Object struct {
+	Tag       [32]byte
+	Encrypted []byte
+	PubKey3Object
+
+	header []byte
+}
+
+func (p *PubKey2Object) Keys() (signing, encryption *btcec.PublicKey) {
+	return p.SigningKey, p.EncryptionKey
+}
+func (p *PubKey2Object) POWParams() POWParams {
+	return NetworkPOWParams
+}
+func (p *PubKey2Object) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 4, 132)
+	order.PutUint32(b, p.Behavior.value())
+	b = append(b, serializePubKey(p.SigningKey)...)
+	b = append(b, serializePubKey(p.EncryptionKey)...)
+	return b, nil
+}
+func (p *PubKey2Object) UnmarshalBinary(b []byte) error {
+	if len(b) < 132 {
+		return io.ErrUnexpectedEOF
+	}
+	p.Behavior.fromValue(order.Uint32(b))
+	var err error
+	p.SigningKey, err = parsePubKey(b[4:])
+	if err != nil {
+		return err
+	}
+	p.EncryptionKey, err = parsePubKey(b[68:])
+	return err
+}
+
+func (p *PubKey3Object) POWParams() POWParams {
+	return POWParams{NonceTrialsPerByte: p.NonceTrialsPerByte, ExtraBytes: p.ExtraBytes}
+}
+
+// signedData will return the encoded pubkey without the signature
+func (p *PubKey3Object) signedData() []byte {
+	b, _ := p.PubKey2Object.MarshalBinary()
+	v := make([]byte, 18)
+	n := encodeBitmessageUvarint(v, p.NonceTrialsPerByte)
+	n += encodeBitmessageUvarint(v[n:], p.ExtraBytes)
+	return append(b, v[:n]...)
+}
+func (p *PubKey3Object) MarshalBinary() ([]byte, error) {
+	b := p.signedData()
+	l := make([]byte, 9)
+	n := encodeBitmessageUvarint(l, uint64(len(p.Signature)))
+	b = append(b, l[:n]...)
+	return append(b, p.Signature...), nil
+}
+func (p *PubKey3Object) UnmarshalBinary(b []byte) error {
+	err := p.PubKey2Object.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	b = b[132:]
+	var n int
+	p.NonceTrialsPerByte, n = decodeBitmessageUvarint(b)
+	if n == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	b = b[n:]
+	p.ExtraBytes, n = decodeBitmessageUvarint(b)
+	if n == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	b = b[n:]
+	l, n := decodeBitmessageUvarint(b)
+	if n == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	if uint64(len(b)-n) < l {
+		return io.ErrUnexpectedEOF
+	}
+	p.Signature = make([]byte, l)
+	copy(p.Signature, b[n:])
+	return nil
+}
+
+// Sign will sign the pubkey in an object with the given header
+func (p *PubKey3Object) Sign(header []byte, key *btcec.PrivateKey) error {
+	sig, err := signData(key, append(append([]byte{}, header...), p.signedData()...))
+	if err != nil {
+		return err
+	}
+	p.Signature = sig
+	return nil
+}
+
+// Verify will check the signature of the pubkey in an object with the given header
+func (p *PubKey3Object) Verify(header []byte) error {
+	return verifySignature(p.SigningKey, append(append([]byte{}, header...), p.signedData()...), p.Signature)
+}
+
+func (p *PubKey4Object) MarshalBinary() ([]byte, error) {
+	b := make([]byte, 32, 32+len(p.Encrypted))
+	copy(b, p.Tag[:])
+	return append(b, p.Encrypted...), nil
+}
+func (p *PubKey4Object) UnmarshalBinary(b []byte) error {
+	if len(b) < 32 {
+		return io.ErrUnexpectedEOF
+	}
+	copy(p.Tag[:], b)
+	p.Encrypted = make([]byte, len(b)-32)
+	copy(p.Encrypted, b[32:])
+	return nil
+}
+
+// Seal will sign the pubkey with key for an object with the given header, then encrypt it for addr
+func (p *PubKey4Object) Seal(header []byte, addr *BMAddress, key *btcec.PrivateKey) error {
+	p.Tag = addr.Tag()
+	err := p.PubKey3Object.Sign(append(append([]byte{}, header...), p.Tag[:]...), key)
+	if err != nil {
+		return err
+	}
+	plain, err := p.PubKey3Object.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.Encrypted, err = Encrypt(addr.PrivateKey().PubKey(), plain)
+	p.header = header
+	return err
+}
+
+// Decrypt will decrypt and verify the pubkey of addr
+func (p *PubKey4Object) Decrypt(addr *BMAddress) error {
+	tag := addr.Tag()
+	if !bytes.Equal(tag[:], p.Tag[:]) {
+		return ErrTagMismatch
+	}
+	plain, err := Decrypt(addr.PrivateKey(), p.Encrypted)
+	if err != nil {
+		return err
+	}
+	var pk PubKey3Object
+	err = pk.UnmarshalBinary(plain)
+	if err != nil {
+		return err
+	}
+	err = pk.Verify(append(append([]byte{}, p.header...), p.Tag[:]...))
+	if err != nil {
+		return err
+	}
+	if CalcRipe(pk.SigningKey, pk.EncryptionKey) != addr.Ripe {
+		return ErrAddressMismatch
+	}
+	p.PubKey3Object = pk
+	return nil
+}
+
+// DecodePubKey will decode the payload of a pubkey object, verifying the signature of v3 pubkeys.
+// A v4 pubkey is returned as an encrypted *PubKey4Object, call Decrypt with its address to read it.
+func (m *ObjectMessage) DecodePubKey() (PubKey, error) {
+	if m.Type != ObjectTypePubKey {
+		return nil, ErrUnknownType
+	}
+	switch m.Version {
+	case 2:
+		p := new(PubKey2Object)
+		return p, p.UnmarshalBinary(m.Payload)
+	case 3:
+		p := new(PubKey3Object)
+		err := p.UnmarshalBinary(m.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return p, p.Verify(m.header())
+	case 4:
+		p := &PubKey4Object{header: m.header()}
+		return p, p.UnmarshalBinary(m.Payload)
+	}
+	return nil, ErrUnknownVersion
+}
@@ -0,0 +1,284 @@
+package bitmessage
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	// PubKeyCacheTime is how long a pubkey is kept in the cache after its object expires
+	PubKeyCacheTime = time.Hour * 24 * 28
+	// MaxObjectTTL is the longest TTL given to objects we create, MaxObjectExpiresTime allows 3 more hours for clock skew
+	MaxObjectTTL = time.Hour * 24 * 28
+)
+
+// pubKeyCache holds every valid pubkey object seen by the ripe (v2, v3) or tag (v4) of its address.
+// v4 pubkeys can only be verified by someone who knows the address, so every object with a tag is
+// kept encrypted until the address is looked up.
+type pubKeyCache struct {
+	s         PubKeyStore
+	mx        sync.Mutex
+	waiters   map[string]chan struct{}
+	requested map[string]time.Time
+}
+
+func newPubKeyCache(s PubKeyStore) *pubKeyCache {
+	return &pubKeyCache{
+		s:         s,
+		waiters:   make(map[string]chan struct{}),
+		requested: make(map[string]time.Time),
+	}
+}
+
+// pubKeyKey will return the key pubkeys of a are cached under, for v4 it is the prefix of every candidate
+func pubKeyKey(a *BMAddress) []byte {
+	if a.Version >= 4 {
+		tag := a.Tag()
+		return tag[:]
+	}
+	return append([]byte{}, a.Ripe[:]...)
+}
+
+// objectPubKeyKey will return the key a pubkey object is stored under and the key of its address, verifying
+// v2 and v3 pubkeys. v4 pubkeys are stored by tag and inventory vector, so a forged object can not replace a real one.
+func objectPubKeyKey(m *ObjectMessage, data []byte) (key, addrKey []byte, err error) {
+	p, err := m.DecodePubKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p4, ok := p.(*PubKey4Object); ok {
+		v := CalcVector(data)
+		return append(p4.Tag[:], v[:]...), p4.Tag[:], nil
+	}
+	ripe := CalcRipe(p.Keys())
+	return ripe[:], ripe[:], nil
+}
+
+// get will load the cached pubkey object for key, or nil
+func (c *pubKeyCache) get(key []byte) (*ObjectMessage, error) {
+	data, err := c.s.GetPubKey(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	m := new(ObjectMessage)
+	return m, m.UnmarshalBinary(data)
+}
+
+// Add will cache a pubkey object, waking anyone waiting for it
+func (c *pubKeyCache) Add(m *ObjectMessage) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	key, addrKey, err := objectPubKeyKey(m, data)
+	if err != nil {
+		return err
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	old, err := c.get(key)
+	if err != nil {
+		return err
+	}
+	if old != nil && !m.Expires.After(old.Expires) {
+		return nil
+	}
+	err = c.s.SavePubKey(key, data)
+	if err != nil {
+		return err
+	}
+	delete(c.requested, string(addrKey))
+	if w := c.waiters[string(addrKey)]; w != nil {
+		close(w)
+		delete(c.waiters, string(addrKey))
+	}
+	return nil
+}
+
+// Get will return the pubkey of a, or nil if it is not cached. v4 candidates that do not decrypt and
+// verify for a are removed, the one that expires last of the rest is returned.
+func (c *pubKeyCache) Get(a *BMAddress) (PubKey, error) {
+	if a.Version < 4 {
+		m, err := c.get(pubKeyKey(a))
+		if err != nil || m == nil {
+			return nil, err
+		}
+		p, err := m.DecodePubKey()
+		if err != nil {
+			return nil, err
+		}
+		if CalcRipe(p.Keys()) != a.Ripe {
+			return nil, ErrAddressMismatch
+		}
+		return p, nil
+	}
+
+	keys, err := c.s.ListPubKeys(pubKeyKey(a))
+	if err != nil {
+		return nil, err
+	}
+	var result PubKey
+	var expires time.Time
+	for _, key := range keys {
+		m, err := c.get(key)
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			continue
+		}
+		p, err := m.DecodePubKey()
+		if err == nil {
+			if p4, ok := p.(*PubKey4Object); ok {
+				err = p4.Decrypt(a)
+			} else {
+				err = ErrTagMismatch
+			}
+		}
+		if err != nil {
+			log.Debugln("removing invalid pubkey for", a.String()+":", err)
+			err = c.s.DeletePubKey(key)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if result == nil || m.Expires.After(expires) {
+			result, expires = p, m.Expires
+		}
+	}
+	return result, nil
+}
+
+// Wait will return a channel that is closed when a pubkey for a is added
+func (c *pubKeyCache) Wait(a *BMAddress) <-chan struct{} {
+	key := string(pubKeyKey(a))
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	w := c.waiters[key]
+	if w == nil {
+		w = make(chan struct{})
+		c.waiters[key] = w
+	}
+	return w
+}
+
+// Request will return true if a pubkey request for a should be sent, recording that one is outstanding until expires
+func (c *pubKeyCache) Request(a *BMAddress, expires time.Time) bool {
+	key := string(pubKeyKey(a))
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.requested[key].After(time.Now()) {
+		return false
+	}
+	c.requested[key] = expires
+	return true
+}
+
+// CancelRequest will forget the outstanding pubkey request for a that was recorded until expires,
+// so the next Request returns true
+func (c *pubKeyCache) CancelRequest(a *BMAddress, expires time.Time) {
+	key := string(pubKeyKey(a))
+	c.mx.Lock()
+	if c.requested[key].Equal(expires) {
+		delete(c.requested, key)
+	}
+	c.mx.Unlock()
+}
+
+// Prune will remove pubkeys that expired PubKeyCacheTime before t, and requests that expired before t
+func (c *pubKeyCache) Prune(t time.Time) error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for key, e := range c.requested {
+		if e.Before(t) {
+			delete(c.requested, key)
+		}
+	}
+	keys, err := c.s.ListPubKeys(nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		m, err := c.get(key)
+		if err != nil {
+			return err
+		}
+		if m != nil && m.Expires.Add(PubKeyCacheTime).After(t) {
+			continue
+		}
+		err = c.s.DeletePubKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PubKey will return the pubkey of addr, publishing getpubkey requests until it arrives or ctx is done.
+// Each unanswered request is retried with double the TTL, up to MaxObjectTTL.
+func (n *Node) PubKey(ctx context.Context, addr *BMAddress) (PubKey, error) {
+	return n.waitPubKey(ctx, addr, nil)
+}
+
+// waitPubKey will return the pubkey of addr, calling waiting before the first request is sent
+func (n *Node) waitPubKey(ctx context.Context, addr *BMAddress, waiting func()) (PubKey, error) {
+	ttl := n.cfg.ObjectTTL
+	for {
+		wait := n.pubkeys.Wait(addr)
+		pk, err := n.pubkeys.Get(addr)
+		if err != nil {
+			log.Warnln("invalid pubkey for", addr.String()+":", err)
+		} else if pk != nil {
+			return pk, nil
+		}
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+		retry, err := n.requestPubKey(ctx, addr, ttl)
+		if err != nil {
+			return nil, err
+		}
+		t := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-wait:
+		case <-t.C:
+			ttl *= 2
+			if ttl > MaxObjectTTL {
+				ttl = MaxObjectTTL
+			}
+		}
+		t.Stop()
+	}
+}
+
+// requestPubKey will publish a getpubkey object for a that lives for ttl unless one is outstanding,
+// returning how long to wait before asking again
+func (n *Node) requestPubKey(ctx context.Context, a *BMAddress, ttl time.Duration) (time.Duration, error) {
+	obj := &ObjectMessage{
+		Expires: time.Now().Add(ttl),
+		Type:    ObjectTypeGetPubKey,
+		Version: a.Version,
+		Stream:  a.Stream,
+	}
+	if !n.pubkeys.Request(a, obj.Expires) {
+		return ttl, nil
+	}
+	obj.Payload = pubKeyKey(a)
+	log.Infoln("requesting pubkey for", a.String())
+	err := obj.DoPOW(ctx, n.cfg.POWEngine, NetworkPOWParams)
+	if err == nil {
+		_, err = n.publish(obj)
+	}
+	if err != nil {
+		n.pubkeys.CancelRequest(a, obj.Expires)
+		return 0, err
+	}
+	return ttl, nil
+}
@@ -0,0 +1,90 @@
+package bitmessage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPubKeyCacheForgedTag(t *testing.T) {
+	id, err := NewRandomIdentity(4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewRandomIdentity(4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	real, err := id.pubKeyObject(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a valid pubkey for another address with id's tag, that expires later
+	forged, err := other.pubKeyObject(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := id.Address.Tag()
+	copy(forged.Payload, tag[:])
+
+	for _, objs := range [][]*ObjectMessage{{real, forged}, {forged, real}} {
+		s := newMemPubKeyStore()
+		c := newPubKeyCache(s)
+		for _, obj := range objs {
+			err = c.Add(obj)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		pk, err := c.Get(&id.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pk == nil {
+			t.Fatal("pubkey was replaced by the forged object")
+		}
+		if _, e := pk.Keys(); !e.IsEqual(id.EncryptionKey.PubKey()) {
+			t.Error("got the wrong encryption key")
+		}
+		if keys, _ := s.ListPubKeys(nil); len(keys) != 1 {
+			t.Errorf("got %d stored pubkeys, expected the forged one to be removed", len(keys))
+		}
+	}
+}
+
+func TestRequestPubKeyCancelled(t *testing.T) {
+	s, err := NewFileStore(filepath.Join(t.TempDir(), "db"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	n, err := NewNodeConfig(Config{ListenAddr: "127.0.0.1:0", BootstrapNodes: []string{}, OutboundConnections: -1}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	id, err := NewRandomIdentity(4, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = n.PubKey(ctx, &id.Address)
+	if err != context.Canceled {
+		t.Fatalf("got %v, expected %v", err, context.Canceled)
+	}
+
+	_, err = n.requestPubKey(context.Background(), &id.Address, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.ListObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 1 {
+		t.Fatalf("got %d objects, expected the getpubkey to be published", len(v))
+	}
+}
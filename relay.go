@@ -0,0 +1,69 @@
+package bitmessage
+
+// maxKnownInventory bounds the per-connection record of vectors a peer has seen
+const maxKnownInventory = MaxInventoryLength * 2
+
+// markKnown records vectors the peer already has, so they are not announced back to it
+func (c *connection) markKnown(v ...InvVector) {
+	c.invmx.Lock()
+	if len(c.known)+len(v) > maxKnownInventory {
+		c.known = make(map[InvVector]bool, len(v))
+	}
+	for _, vect := range v {
+		c.known[vect] = true
+	}
+	c.invmx.Unlock()
+}
+
+// queueInv will queue v to be announced to the peer on the next relay tick
+func (c *connection) queueInv(v InvVector) {
+	c.invmx.Lock()
+	if !c.known[v] {
+		c.known[v] = true
+		c.pendingInv = append(c.pendingInv, v)
+	}
+	c.invmx.Unlock()
+}
+
+// takeInv will return and clear the queued announcements
+func (c *connection) takeInv() []InvVector {
+	c.invmx.Lock()
+	v := c.pendingInv
+	c.pendingInv = nil
+	c.invmx.Unlock()
+	return v
+}
+
+// flushInv will send all queued announcements as InvMessages
+func (c *connection) flushInv() error {
+	return c.sendInv(c.takeInv())
+}
+
+// sendInv will send inv to the peer, split into InvMessages of at most MaxInventoryLength
+func (c *connection) sendInv(inv []InvVector) error {
+	c.markKnown(inv...)
+	for len(inv) > 0 {
+		n := len(inv)
+		if n > MaxInventoryLength {
+			n = MaxInventoryLength
+		}
+		err := c.send(&InvMessage{Inventory: inv[:n]})
+		if err != nil {
+			return err
+		}
+		inv = inv[n:]
+	}
+	return nil
+}
+
+// announce will queue v for announcement to every connected peer in stream, except from
+func (n *Node) announce(v InvVector, stream uint64, from *connection) {
+	n.poolmx.RLock()
+	for _, c := range n.pool {
+		if c == from || !hasStream(c.streams, stream) {
+			continue
+		}
+		c.queueInv(v)
+	}
+	n.poolmx.RUnlock()
+}
@@ -0,0 +1,440 @@
+package bitmessage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultObjectTTL is how long objects we create live for
+	DefaultObjectTTL = time.Hour * 24 * 4
+	// ackDataLength is the length of the random payload of an ack
+	ackDataLength = 32
+)
+
+var ErrNotAcknowledged = errors.New("message was not acknowledged")
+
+// SendStatus is the delivery state of a SentMessage
+type SendStatus int
+
+const (
+	SendAwaitingPubKey SendStatus = iota
+	SendDoingPOW
+	SendSent
+	SendAcknowledged
+	SendFailed
+)
+
+func (s SendStatus) String() string {
+	switch s {
+	case SendAwaitingPubKey:
+		return "awaiting pubkey"
+	case SendDoingPOW:
+		return "doing POW"
+	case SendSent:
+		return "sent"
+	case SendAcknowledged:
+		return "acknowledged"
+	case SendFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("SendStatus(%d)", int(s))
+}
+
+// SentMessage is a message being sent by a Node
+type SentMessage struct {
+	From     *Identity
+	To       BMAddress
+	Encoding uint64
+	MessageContent
+
+	message []byte
+	mx      sync.Mutex
+	status  SendStatus
+	err     error
+	vector  InvVector
+	ackData []byte
+	changed chan struct{}
+	// ttl is used for the next msg object, expires is when the last one published expires
+	ttl     time.Duration
+	expires time.Time
+}
+
+// Status will return the current status, and the error if it failed
+func (m *SentMessage) Status() (SendStatus, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.status, m.err
+}
+
+// Vector will return the inventory vector of the msg object, once it has been sent
+func (m *SentMessage) Vector() InvVector {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.vector
+}
+
+// Changed will return a channel that is closed on the next status change
+func (m *SentMessage) Changed() <-chan struct{} {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.changed
+}
+
+func (m *SentMessage) setStatus(s SendStatus, err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.status == s || m.status == SendAcknowledged || m.status == SendFailed {
+		return
+	}
+	m.status = s
+	m.err = err
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// marshal will encode m to be saved in a SendStore
+func (m *SentMessage) marshal() []byte {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	var expires uint64
+	if !m.expires.IsZero() {
+		expires = uint64(m.expires.Unix())
+	}
+	b := appendVarBytes(nil, []byte(m.From.Address.String()))
+	b = appendVarBytes(b, []byte(m.To.String()))
+	b = appendVarint(b, m.Encoding)
+	b = appendVarBytes(b, m.message)
+	b = appendVarBytes(b, m.ackData)
+	b = append(b, m.vector[:]...)
+	b = appendVarint(b, expires)
+	return appendVarint(b, uint64(m.ttl/time.Second))
+}
+
+// unmarshalSentMessage will decode a message saved by marshal, returning the address of its sender
+func unmarshalSentMessage(b []byte) (*SentMessage, *BMAddress, error) {
+	r := &plainReader{b: b}
+	from := r.varBytes()
+	to := r.varBytes()
+	m := &SentMessage{changed: make(chan struct{})}
+	m.Encoding = r.varint()
+	m.message = r.varBytes()
+	m.ackData = r.varBytes()
+	copy(m.vector[:], r.bytes(32))
+	expires := r.varint()
+	m.ttl = time.Duration(r.varint()) * time.Second
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	fromAddr, err := ParseBMAddress(string(from))
+	if err != nil {
+		return nil, nil, err
+	}
+	toAddr, err := ParseBMAddress(string(to))
+	if err != nil {
+		return nil, nil, err
+	}
+	m.To = *toAddr
+	if c, err := DecodeMessageContent(m.Encoding, m.message); err == nil {
+		m.MessageContent = *c
+	}
+	if expires != 0 {
+		m.expires = time.Unix(int64(expires), 0)
+		m.status = SendSent
+	}
+	return m, fromAddr, nil
+}
+
+// sender will return the sender information included in messages from the identity
+func (id *Identity) sender() Sender {
+	return Sender{
+		Address:            id.Address,
+		Behavior:           PubKeyBehavior{DoesAck: !id.SuppressAcks},
+		SigningKey:         id.SigningKey.PubKey(),
+		EncryptionKey:      id.EncryptionKey.PubKey(),
+		NonceTrialsPerByte: NetworkNonceTrialsPerByte,
+		ExtraBytes:         NetworkPayloadLengthExtraBytes,
+	}
+}
+
+// Send will send a message with the simple encoding from one of our identities, the returned SentMessage reports its progress.
+// Delivery continues in the background until the message is acknowledged, and resumes after a restart if the Store is a SendStore.
+func (n *Node) Send(from *Identity, to *BMAddress, subject, body string) (*SentMessage, error) {
+	return n.SendContent(from, to, EncodingSimple, &MessageContent{Subject: subject, Body: body})
+}
+
+// SendContent is like Send, but encodes c with encoding
+func (n *Node) SendContent(from *Identity, to *BMAddress, encoding uint64, c *MessageContent) (*SentMessage, error) {
+	if !n.servesStream(to.Stream) {
+		return nil, ErrStreamNotServed
+	}
+	msg, err := c.Encode(encoding)
+	if err != nil {
+		return nil, err
+	}
+	ack := make([]byte, ackDataLength)
+	_, err = io.ReadFull(rand.Reader, ack)
+	if err != nil {
+		return nil, err
+	}
+	m := &SentMessage{
+		From:           from,
+		To:             *to,
+		Encoding:       encoding,
+		MessageContent: *c,
+		message:        msg,
+		ackData:        ack,
+		changed:        make(chan struct{}),
+		ttl:            n.cfg.ObjectTTL,
+	}
+	n.sendmx.Lock()
+	n.acks[string(ack)] = m
+	n.sendmx.Unlock()
+	n.saveSend(m)
+	if !n.spawn(func() { n.deliver(m) }) {
+		n.sendDone(m)
+		return nil, ErrNodeClosed
+	}
+	return m, nil
+}
+
+// Sending will return the messages being delivered. Messages saved before a restart are included,
+// their From is nil until their identity is added with AddIdentity.
+func (n *Node) Sending() []*SentMessage {
+	n.sendmx.Lock()
+	defer n.sendmx.Unlock()
+	result := make([]*SentMessage, 0, len(n.acks))
+	for _, m := range n.acks {
+		result = append(result, m)
+	}
+	return result
+}
+
+// saveSend will save m so its delivery resumes after a restart
+func (n *Node) saveSend(m *SentMessage) {
+	err := n.sends.SaveSend(m.ackData, m.marshal())
+	if err != nil {
+		log.Warnln("failed to save sent message:", err)
+	}
+}
+
+// sendDone will stop tracking m
+func (n *Node) sendDone(m *SentMessage) {
+	n.sendmx.Lock()
+	delete(n.acks, string(m.ackData))
+	n.sendmx.Unlock()
+	err := n.sends.DeleteSend(m.ackData)
+	if err != nil {
+		log.Warnln("failed to delete sent message:", err)
+	}
+}
+
+// loadSends will watch for the acks of saved messages, their delivery resumes when AddIdentity is called for their sender
+func (n *Node) loadSends() error {
+	sends, err := n.sends.ListSends()
+	if err != nil {
+		return err
+	}
+	for _, data := range sends {
+		m, from, err := unmarshalSentMessage(data)
+		if err != nil {
+			log.Warnln("ignoring saved message:", err)
+			continue
+		}
+		n.acks[string(m.ackData)] = m
+		n.resume[*from] = append(n.resume[*from], m)
+	}
+	return nil
+}
+
+// resumeSends will continue delivering the saved messages from id
+func (n *Node) resumeSends(id *Identity) {
+	n.sendmx.Lock()
+	ms := n.resume[id.Address]
+	delete(n.resume, id.Address)
+	for _, m := range ms {
+		m.From = id
+	}
+	n.sendmx.Unlock()
+	for _, m := range ms {
+		m := m
+		log.Infoln("resuming message to", m.To.String())
+		n.spawn(func() { n.deliver(m) })
+	}
+}
+
+// deliver will get the recipient's pubkey, then build and publish the message until it is acknowledged.
+// Each time the msg object expires without an ack it is sent again with double the TTL, up to MaxObjectTTL.
+// If the node is closed first the message stays saved, to be resumed.
+func (n *Node) deliver(m *SentMessage) {
+	if s, _ := m.Status(); s == SendAcknowledged {
+		n.sendDone(m)
+		return
+	}
+	ctx, cancel := n.context()
+	defer cancel()
+	err := n.deliverMsg(ctx, m)
+	if err != nil {
+		m.setStatus(SendFailed, err)
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	n.sendDone(m)
+}
+
+func (n *Node) deliverMsg(ctx context.Context, m *SentMessage) error {
+	pk, err := n.waitPubKey(ctx, &m.To, func() { m.setStatus(SendAwaitingPubKey, nil) })
+	if err != nil {
+		return err
+	}
+	doesAck := pubKeyBehavior(pk).DoesAck
+	for {
+		m.mx.Lock()
+		ttl, expires := m.ttl, m.expires
+		m.mx.Unlock()
+		// a resumed message is only sent again once its last msg object expires
+		if !expires.After(time.Now()) {
+			m.setStatus(SendDoingPOW, nil)
+			obj, err := n.buildMsg(ctx, m, pk, ttl)
+			if err != nil {
+				return err
+			}
+			v, err := n.publish(obj)
+			if err != nil {
+				return err
+			}
+			expires = obj.Expires
+			m.mx.Lock()
+			m.vector = v
+			m.expires = expires
+			m.mx.Unlock()
+			n.saveSend(m)
+		}
+		m.setStatus(SendSent, nil)
+		if !doesAck {
+			return nil
+		}
+
+		acked, err := waitAck(ctx, m, expires.Sub(time.Now()))
+		if acked || err != nil {
+			return err
+		}
+		if ttl >= MaxObjectTTL {
+			return ErrNotAcknowledged
+		}
+		ttl *= 2
+		if ttl > MaxObjectTTL {
+			ttl = MaxObjectTTL
+		}
+		m.mx.Lock()
+		m.ttl = ttl
+		m.mx.Unlock()
+		n.saveSend(m)
+		log.Infoln("no ack from", m.To.String()+", resending")
+	}
+}
+
+// waitAck will wait up to d for m to be acknowledged
+func waitAck(ctx context.Context, m *SentMessage, d time.Duration) (bool, error) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		changed := m.Changed()
+		if s, _ := m.Status(); s == SendAcknowledged {
+			return true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-changed:
+		case <-t.C:
+			return false, nil
+		}
+	}
+}
+
+// buildAck will create the ack object the recipient publishes to acknowledge m, encoded as a complete object message
+func (n *Node) buildAck(ctx context.Context, m *SentMessage, expires time.Time) ([]byte, error) {
+	obj := &ObjectMessage{
+		Expires: expires,
+		Type:    ObjectTypeMsg,
+		Version: 1,
+		Stream:  m.From.Address.Stream,
+		Payload: m.ackData,
+	}
+	err := obj.DoPOW(ctx, n.cfg.POWEngine, NetworkPOWParams)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	w := &MessageWriter{buf}
+	_, err = w.WriteMessage(obj)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// buildMsg will sign, encrypt and do the POW of the msg object for m
+func (n *Node) buildMsg(ctx context.Context, m *SentMessage, pk PubKey, ttl time.Duration) (*ObjectMessage, error) {
+	expires := time.Now().Add(ttl)
+	ack, err := n.buildAck(ctx, m, expires)
+	if err != nil {
+		return nil, err
+	}
+	obj := &ObjectMessage{
+		Expires: expires,
+		Type:    ObjectTypeMsg,
+		Version: 1,
+		Stream:  m.To.Stream,
+	}
+	pm := &PlainMessage{
+		From:     m.From.sender(),
+		To:       m.To,
+		Encoding: m.Encoding,
+		Message:  m.message,
+		Ack:      ack,
+	}
+	err = pm.Sign(obj.header(), m.From.SigningKey)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := pm.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	_, enc := pk.Keys()
+	obj.Payload, err = Encrypt(enc, plain)
+	if err != nil {
+		return nil, err
+	}
+	err = obj.DoPOW(ctx, n.cfg.POWEngine, pk.POWParams())
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// ackReceived will mark the message acknowledged by a msg object with payload, if any
+func (n *Node) ackReceived(payload []byte) {
+	n.sendmx.Lock()
+	m := n.acks[string(payload)]
+	delete(n.acks, string(payload))
+	n.sendmx.Unlock()
+	if m != nil {
+		log.Infoln("message to", m.To.String(), "acknowledged")
+		m.setStatus(SendAcknowledged, nil)
+		err := n.sends.DeleteSend(m.ackData)
+		if err != nil {
+			log.Warnln("failed to delete sent message:", err)
+		}
+	}
+}
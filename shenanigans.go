@@ -21,16 +21,28 @@ func encodeBitmessageUvarint(b []byte, v uint64) int {
 	return 9
 }
 
-// decodeBitmessageUvarint will decode from the bitmessage varint format
+// decodeBitmessageUvarint will decode from the bitmessage varint format, the size is 0 if b is too short
 func decodeBitmessageUvarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
 	if b[0] < 0xfd {
 		return uint64(b[0]), 1
 	}
 	if b[0] == 0xfd {
+		if len(b) < 3 {
+			return 0, 0
+		}
 		return uint64(order.Uint16(b[1:])), 3
 	}
 	if b[0] == 0xfe {
+		if len(b) < 5 {
+			return 0, 0
+		}
 		return uint64(order.Uint32(b[1:])), 5
 	}
+	if len(b) < 9 {
+		return 0, 0
+	}
 	return order.Uint64(b[1:]), 9
 }
@@ -0,0 +1,50 @@
+package bitmessage
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"github.com/btcsuite/btcd/btcec"
+)
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// signData will return the DER encoded ECDSA signature of the SHA-256 of data
+func signData(key *btcec.PrivateKey, data []byte) ([]byte, error) {
+	h := sha256.Sum256(data)
+	sig, err := key.Sign(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// verifySignature will check a DER encoded ECDSA signature of data, older clients sign the SHA-1 of data instead of SHA-256
+func verifySignature(key *btcec.PublicKey, data, sig []byte) error {
+	s, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	h256 := sha256.Sum256(data)
+	if s.Verify(h256[:], key) {
+		return nil
+	}
+	h1 := sha1.Sum(data)
+	if s.Verify(h1[:], key) {
+		return nil
+	}
+	return ErrInvalidSignature
+}
+
+// parsePubKey will parse a public key encoded as 64 bytes of X and Y
+func parsePubKey(b []byte) (*btcec.PublicKey, error) {
+	k := make([]byte, 65)
+	k[0] = 4
+	copy(k[1:], b[:64])
+	return btcec.ParsePubKey(k, btcec.S256())
+}
+
+// serializePubKey will encode a public key as 64 bytes of X and Y
+func serializePubKey(key *btcec.PublicKey) []byte {
+	return key.SerializeUncompressed()[1:]
+}
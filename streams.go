@@ -0,0 +1,45 @@
+package bitmessage
+
+// childStreams will return the left and right child streams of stream
+func childStreams(stream uint64) [2]uint64 {
+	return [2]uint64{stream * 2, stream*2 + 1}
+}
+
+func hasStream(streams []uint64, stream uint64) bool {
+	for _, s := range streams {
+		if s == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// sharedStreams will return the streams found in both a and b
+func sharedStreams(a, b []uint64) []uint64 {
+	var result []uint64
+	for _, s := range a {
+		if hasStream(b, s) && !hasStream(result, s) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// withChildStreams will return streams along with their child streams. Nodes
+// learn and advertise addresses of their child streams so new nodes can find them.
+func withChildStreams(streams []uint64) []uint64 {
+	result := make([]uint64, 0, len(streams)*3)
+	for _, s := range streams {
+		if !hasStream(result, s) {
+			result = append(result, s)
+		}
+	}
+	for _, s := range streams {
+		for _, c := range childStreams(s) {
+			if !hasStream(result, c) {
+				result = append(result, c)
+			}
+		}
+	}
+	return result
+}
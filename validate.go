@@ -0,0 +1,59 @@
+package bitmessage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	MaxObjectPayloadLength = 1 << 18
+	ObjectExpiredGrace     = time.Hour
+)
+
+var ErrInsufficientPOW = errors.New("insufficient proof of work")
+var ErrObjectExpired = errors.New("object has expired")
+var ErrObjectExpiresTooLate = errors.New("object expires too far in the future")
+var ErrObjectTooLarge = errors.New("object is larger than maximum allowed")
+var ErrObjectTooShort = errors.New("object is shorter than the object header")
+var ErrStreamNotServed = errors.New("object is for a stream we do not serve")
+
+// ObjectError is returned when an object fails validation, Reason is one of the ErrObject*, ErrInsufficientPOW or ErrStreamNotServed values
+type ObjectError struct {
+	Vector InvVector
+	Reason error
+}
+
+func (e *ObjectError) Error() string {
+	return fmt.Sprintf("invalid object %s: %s", e.Vector, e.Reason.Error())
+}
+
+// ValidateObject will check the size, expiration time and proof of work of an encoded object using the network defaults
+func ValidateObject(data []byte) error {
+	if len(data) < 20 {
+		return &ObjectError{Reason: ErrObjectTooShort}
+	}
+	vect := CalcVector(data)
+	if len(data) > MaxObjectPayloadLength {
+		return &ObjectError{Vector: vect, Reason: ErrObjectTooLarge}
+	}
+	ttl := time.Unix(int64(order.Uint64(data[8:])), 0).Sub(time.Now())
+	if ttl > MaxObjectExpiresTime {
+		return &ObjectError{Vector: vect, Reason: ErrObjectExpiresTooLate}
+	}
+	if ttl < -ObjectExpiredGrace {
+		return &ObjectError{Vector: vect, Reason: ErrObjectExpired}
+	}
+	if GetPOWValue(data) > NetworkPOWParams.Target(len(data), ttl) {
+		return &ObjectError{Vector: vect, Reason: ErrInsufficientPOW}
+	}
+	return nil
+}
+
+// validateObject will check an object received from the network before it is stored
+func (n *Node) validateObject(m *ObjectMessage, data []byte) error {
+	if !n.servesStream(m.Stream) {
+		return &ObjectError{Vector: CalcVector(data), Reason: ErrStreamNotServed}
+	}
+	return ValidateObject(data)
+}